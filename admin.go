@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+)
+
+// AclStatus is the result of the last fetches of one acl source
+type AclStatus struct {
+	LastFetch   time.Time `json:"last_fetch"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	OK          bool      `json:"ok"`
+	Pubkeys     int       `json:"pubkeys"`
+}
+
+// aclStatuses maps acl source id -> AclStatus
+var aclStatuses sync.Map
+
+func recordAclFetch(as policy.AclSource, ok bool, at time.Time, m *sync.Map) {
+	var st AclStatus
+	if v, found := aclStatuses.Load(as.ID); found {
+		st = v.(AclStatus)
+	}
+	st.LastFetch = at
+	st.OK = ok
+	if ok {
+		st.LastSuccess = at
+	}
+	st.Pubkeys = 0
+	m.Range(func(k, v interface{}) bool {
+		if v == as.ID {
+			st.Pubkeys++
+		}
+		return true
+	})
+	aclStatuses.Store(as.ID, st)
+}
+
+// adminServer answers questions about the running policy and edits the
+// overrides. It is meant for localhost or a unix socket only.
+type adminServer struct {
+	policy    *policy.Policy
+	relay     *atomic.Pointer[policy.Relay]
+	pubkeys   *sync.Map
+	overrides *Overrides
+	bans      *Bans
+	token     string
+}
+
+// serveAdmin starts the admin API on addr in the background. addr is a
+// host:port or unix:/path/to/socket.
+func serveAdmin(addr string, token string, a *adminServer) error {
+	a.token = token
+	var l net.Listener
+	var err error
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// a socket left over from the last run
+		os.Remove(path)
+		l, err = net.Listen("unix", path)
+		if err == nil {
+			os.Chmod(path, 0600)
+		}
+	} else {
+		if !loopbackAddr(addr) {
+			if token == "" {
+				return fmt.Errorf("admin API on %s is not limited to localhost, set ADMIN_TOKEN", addr)
+			}
+			log(fmt.Sprintf("Warn: admin API on %s is not limited to localhost", addr))
+		}
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/relay", a.handleRelay)
+	mux.HandleFunc("/acl", a.handleAcl)
+	mux.HandleFunc("/pubkeys/", a.handlePubkey)
+	mux.HandleFunc("/decide", a.handleDecide)
+	mux.HandleFunc("/overrides", a.handleOverrides)
+	mux.HandleFunc("/overrides/", a.handleOverride)
+	mux.HandleFunc("/bans", a.handleBans)
+	mux.HandleFunc("/bans/", a.handleBan)
+	mux.HandleFunc("/outbox", a.handleOutbox)
+	mux.HandleFunc("/history", a.handleHistory)
+	go func() {
+		log(fmt.Sprintf("Info: serving admin API on %s", addr))
+		if err := http.Serve(l, a.auth(mux)); err != nil {
+			log(fmt.Sprintf("admin listener stopped: %s", err.Error()))
+		}
+	}()
+	return nil
+}
+
+// loopbackAddr reports whether a host:port only listens on localhost
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+func (a *adminServer) auth(next http.Handler) http.Handler {
+	want := []byte("Bearer " + a.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+// GET /relay returns the relay snapshot the policy is using
+func (a *adminServer) handleRelay(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	relay := a.relay.Load()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version": relay.Version(),
+		"relay":   relay,
+	})
+}
+
+type aclSourceStatus struct {
+	policy.AclSource
+	Status *AclStatus `json:"status"`
+}
+
+// GET /acl lists the acl sources of the relay and their last fetch
+func (a *adminServer) handleAcl(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	relay := a.relay.Load()
+	list := make([]aclSourceStatus, 0, len(relay.AclSources))
+	for _, as := range relay.AclSources {
+		s := aclSourceStatus{AclSource: as}
+		if v, ok := aclStatuses.Load(as.ID); ok {
+			st := v.(AclStatus)
+			s.Status = &st
+		}
+		list = append(list, s)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+type pubkeyInfo struct {
+	Pubkey      string    `json:"pubkey"`
+	Source      string    `json:"source,omitempty"`
+	Moderator   bool      `json:"moderator"`
+	AllowListed bool      `json:"allow_listed"`
+	BlockListed bool      `json:"block_listed"`
+	Override    *Override `json:"override,omitempty"`
+	Ban         *Ban      `json:"ban,omitempty"`
+}
+
+// GET /pubkeys/{pubkey} shows what the plugin knows about a pubkey
+func (a *adminServer) handlePubkey(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	pubkey := policy.DecodePub(strings.TrimPrefix(r.URL.Path, "/pubkeys/"))
+	if !validPubkey(pubkey) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%q is not a hex pubkey or npub", pubkey))
+		return
+	}
+	relay := a.relay.Load()
+	now := time.Now()
+	info := pubkeyInfo{Pubkey: pubkey}
+	if v, ok := a.pubkeys.Load(pubkey); ok {
+		info.Source, _ = v.(string)
+	}
+	for _, m := range relay.Moderators {
+		if policy.DecodePub(m.User.Pubkey) == pubkey {
+			info.Moderator = true
+		}
+	}
+	for _, p := range relay.AllowList.ListPubkeys {
+		if policy.DecodePub(p.Pubkey) == pubkey && !p.ExpiresAt.Expired(now) {
+			info.AllowListed = true
+		}
+	}
+	if managed.allowedPubkey(pubkey) {
+		info.AllowListed = true
+	}
+	for _, p := range relay.BlockList.ListPubkeys {
+		if policy.DecodePub(p.Pubkey) == pubkey && !p.ExpiresAt.Expired(now) {
+			info.BlockListed = true
+		}
+	}
+	if ov, ok := a.overrides.Get(pubkey); ok {
+		info.Override = &ov
+	}
+	if ban, ok := a.bans.Get(pubkey); ok {
+		info.Ban = &ban
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+type decideResult struct {
+	Action    string            `json:"action"`
+	Msg       string            `json:"msg"`
+	Rule      string            `json:"rule"`
+	ModAction *policy.ModAction `json:"mod_action,omitempty"`
+}
+
+// POST /decide runs the policy on a hypothetical event without acting on
+// it. The body is a strfry input line or a bare nostr event.
+func (a *adminServer) handleDecide(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(http.MaxBytesReader(w, r.Body, 1<<20)); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(body.Bytes(), &probe); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var e policy.StrfryEvent
+	if _, ok := probe["event"]; ok {
+		if err := json.Unmarshal(body.Bytes(), &e); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	} else if err := json.Unmarshal(body.Bytes(), &e.Event); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if e.Type == "" {
+		e.Type = "new"
+	}
+	if e.SourceType == "" {
+		e.SourceType = "IP4"
+		e.SourceInfo = "127.0.0.1"
+	}
+	if e.ReceivedAt == 0 {
+		e.ReceivedAt = int(time.Now().Unix())
+	}
+	if e.Event.CreatedAt == 0 {
+		e.Event.CreatedAt = int(time.Now().Unix())
+	}
+	e.Event.Pubkey = policy.DecodePub(e.Event.Pubkey)
+
+	d := a.policy.DecideDryRun(e, *a.relay.Load(), currentACL())
+	writeJSON(w, http.StatusOK, decideResult{Action: d.Action, Msg: d.Msg, Rule: d.Rule, ModAction: d.ModAction})
+}
+
+type overrideRequest struct {
+	Pubkey          string        `json:"pubkey"`
+	Action          string        `json:"action"`
+	Reason          string        `json:"reason"`
+	DurationSeconds int           `json:"duration_seconds"`
+	ExpiresAt       policy.Expiry `json:"expires_at"`
+}
+
+// GET /overrides lists the overrides, POST /overrides adds or replaces one
+func (a *adminServer) handleOverrides(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, a.overrides.List())
+		return
+	}
+	var req overrideRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ov := Override{
+		Pubkey:    req.Pubkey,
+		Action:    req.Action,
+		Reason:    req.Reason,
+		ExpiresAt: req.ExpiresAt,
+	}
+	if req.DurationSeconds > 0 {
+		ov.ExpiresAt = policy.Expiry{Time: time.Now().Add(time.Duration(req.DurationSeconds) * time.Second).UTC()}
+	}
+	if err := a.overrides.Set(ov); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ov, _ = a.overrides.Get(policy.DecodePub(req.Pubkey))
+	log(fmt.Sprintf("admin: %s override for %s, reason: %s", ov.Action, ov.Pubkey, ov.Reason))
+	writeJSON(w, http.StatusOK, ov)
+}
+
+// DELETE /overrides/{pubkey} removes an override
+func (a *adminServer) handleOverride(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodDelete) {
+		return
+	}
+	pubkey := strings.TrimPrefix(r.URL.Path, "/overrides/")
+	ok, err := a.overrides.Remove(pubkey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no override for %s", pubkey))
+		return
+	}
+	log(fmt.Sprintf("admin: removed override for %s", pubkey))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /bans lists the pubkeys banned by moderators
+func (a *adminServer) handleBans(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.bans.List())
+}
+
+// DELETE /bans/{pubkey} lifts a ban
+func (a *adminServer) handleBan(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodDelete) {
+		return
+	}
+	pubkey := strings.TrimPrefix(r.URL.Path, "/bans/")
+	ok, err := a.bans.Remove(pubkey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no ban for %s", pubkey))
+		return
+	}
+	log(fmt.Sprintf("admin: removed ban for %s", pubkey))
+	history.Record(HistoryEntry{Action: "unbanPubkey", Moderator: "admin", Pubkey: policy.DecodePub(pubkey), Reason: "admin API"})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /outbox lists the changes not sent to the config API yet
+func (a *adminServer) handleOutbox(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, outbox.Pending())
+}
+
+// GET /history lists recent moderation actions, newest first. ?pubkey=
+// limits it to one pubkey, ?limit= sets how many (100 by default).
+func (a *adminServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", l))
+			return
+		}
+		limit = n
+	}
+	pubkey := r.URL.Query().Get("pubkey")
+	if pubkey != "" {
+		pubkey = policy.DecodePub(pubkey)
+	}
+	writeJSON(w, http.StatusOK, history.List(pubkey, limit))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:9096", true},
+		{"[::1]:9096", true},
+		{"localhost:9096", true},
+		{"0.0.0.0:9096", false},
+		{":9096", false},
+		{"10.0.0.5:9096", false},
+		{"example.com:9096", false},
+		{"nonsense", false},
+	}
+	for _, tt := range tests {
+		if got := loopbackAddr(tt.addr); got != tt.want {
+			t.Errorf("loopbackAddr(%q) = %t, want %t", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestServeAdminNeedsToken(t *testing.T) {
+	if err := serveAdmin("0.0.0.0:0", "", &adminServer{}); err == nil {
+		t.Error("the admin API started on a public address without a token")
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	a := &adminServer{token: "secret"}
+	h := a.auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for header, want := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+		"secret":        http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/relay", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("Authorization %q: status %d, want %d", header, w.Code, want)
+		}
+	}
+}
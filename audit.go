@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+	"github.com/spf13/viper"
+)
+
+// audit log settings from .spamblaster.env
+type auditConfig struct {
+	Path          string `mapstructure:"AUDIT_LOG"` // empty disables the audit log
+	MaxSizeMB     int    `mapstructure:"AUDIT_LOG_MAX_SIZE_MB"`
+	MaxAgeHours   int    `mapstructure:"AUDIT_LOG_MAX_AGE_HOURS"`
+	RetentionDays int    `mapstructure:"AUDIT_LOG_RETENTION_DAYS"`
+}
+
+func setAuditDefaults() {
+	viper.SetDefault("AUDIT_LOG", "")
+	viper.SetDefault("AUDIT_LOG_MAX_SIZE_MB", 100)
+	viper.SetDefault("AUDIT_LOG_MAX_AGE_HOURS", 24)
+	viper.SetDefault("AUDIT_LOG_RETENTION_DAYS", 30)
+}
+
+// AuditRecord is one line of the audit log
+type AuditRecord struct {
+	Time          time.Time         `json:"time"`
+	EventID       string            `json:"event_id"`
+	Pubkey        string            `json:"pubkey"`
+	Kind          int               `json:"kind"`
+	SourceType    string            `json:"source_type"`
+	SourceIP      string            `json:"source_ip,omitempty"`
+	Action        string            `json:"action"`
+	Rule          string            `json:"rule"`
+	Reason        string            `json:"reason,omitempty"`
+	ModAction     *policy.ModAction `json:"mod_action,omitempty"`
+	ConfigVersion string            `json:"config_version"`
+}
+
+func newAuditRecord(e policy.StrfryEvent, d policy.Decision, relay *policy.Relay) AuditRecord {
+	rec := AuditRecord{
+		Time:          time.Now().UTC(),
+		EventID:       e.Event.ID,
+		Pubkey:        e.Event.Pubkey,
+		Kind:          e.Event.Kind,
+		SourceType:    e.SourceType,
+		Action:        d.Action,
+		Rule:          d.Rule,
+		Reason:        d.Msg,
+		ModAction:     d.ModAction,
+		ConfigVersion: relay.Version(),
+	}
+	if e.SourceType == "IP4" || e.SourceType == "IP6" {
+		rec.SourceIP = e.SourceInfo
+	}
+	return rec
+}
+
+// auditLog is a JSONL file that is rotated by size and age. Rotated files
+// are renamed with a timestamp suffix and removed after the retention period.
+// When the file cannot be opened again after a rotation, records are dropped
+// and logged until it can.
+type auditLog struct {
+	cfg auditConfig
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openAuditLog(cfg auditConfig) (*auditLog, error) {
+	a := &auditLog{cfg: cfg}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	a.opened = time.Now()
+	return nil
+}
+
+// Write appends a record, rotating the file first when it is due
+func (a *auditLog) Write(rec AuditRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log(fmt.Sprintf("error marshaling audit record: %s", err.Error()))
+		return
+	}
+	b = append(b, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.due(int64(len(b))) {
+		if err := a.rotate(); err != nil {
+			log(fmt.Sprintf("error rotating audit log: %s", err.Error()))
+		}
+	}
+	if a.file == nil {
+		if err := a.open(); err != nil {
+			log(fmt.Sprintf("error opening audit log, dropping record for %s: %s", rec.EventID, err.Error()))
+			return
+		}
+	}
+	n, err := a.file.Write(b)
+	a.size += int64(n)
+	if err != nil {
+		log(fmt.Sprintf("error writing audit log: %s", err.Error()))
+	}
+}
+
+func (a *auditLog) due(next int64) bool {
+	if a.size == 0 {
+		return false
+	}
+	if a.cfg.MaxSizeMB > 0 && a.size+next > int64(a.cfg.MaxSizeMB)*1024*1024 {
+		return true
+	}
+	return a.cfg.MaxAgeHours > 0 && time.Since(a.opened) > time.Duration(a.cfg.MaxAgeHours)*time.Hour
+}
+
+// rotatedLayout is the suffix of rotated files, with nanoseconds so two
+// rotations in a second do not collide. Parsing with rotatedParseLayout
+// reads names with and without the fraction.
+const (
+	rotatedLayout      = "20060102T150405.000000000"
+	rotatedParseLayout = "20060102T150405"
+)
+
+// rotatedName is a name for the rotated file that is not taken yet
+func (a *auditLog) rotatedName() string {
+	base := a.cfg.Path + "." + time.Now().UTC().Format(rotatedLayout)
+	name := base
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+func (a *auditLog) rotate() error {
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+		a.size = 0
+	}
+	if err := os.Rename(a.cfg.Path, a.rotatedName()); err != nil {
+		log(fmt.Sprintf("error renaming audit log: %s", err.Error()))
+	}
+	a.cleanup()
+	if err := a.open(); err != nil {
+		return fmt.Errorf("reopening %s: %w", a.cfg.Path, err)
+	}
+	return nil
+}
+
+// cleanup removes rotated files older than the retention period
+func (a *auditLog) cleanup() {
+	if a.cfg.RetentionDays <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(a.cfg.Path + ".*")
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-time.Duration(a.cfg.RetentionDays) * 24 * time.Hour)
+	for _, m := range matches {
+		suffix, _, _ := strings.Cut(strings.TrimPrefix(m, a.cfg.Path+"."), "-")
+		t, err := time.Parse(rotatedParseLayout, suffix)
+		if err != nil || !t.Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(m); err != nil {
+			log(fmt.Sprintf("error removing old audit log %s: %s", m, err.Error()))
+		} else {
+			log(fmt.Sprintf("removed old audit log %s", m))
+		}
+	}
+}
+
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditRotateNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := openAuditLog(auditConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for i := 0; i < 3; i++ {
+		a.Write(AuditRecord{EventID: "e"})
+		a.mu.Lock()
+		err := a.rotate()
+		a.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 3 {
+		t.Errorf("rotated files = %v, want 3", rotated)
+	}
+}
+
+func TestAuditCleanupOldNames(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	for _, name := range []string{"20200101T000000", "20200101T000000.123456789", "20200101T000000.123456789-1", "29990101T000000.000000000"} {
+		if err := os.WriteFile(path+"."+name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &auditLog{cfg: auditConfig{Path: path, RetentionDays: 1}}
+	a.cleanup()
+	left, _ := filepath.Glob(path + ".*")
+	if len(left) != 1 || !strings.HasSuffix(left[0], ".29990101T000000.000000000") {
+		t.Errorf("left after cleanup %v, want only the recent file", left)
+	}
+}
+
+func TestAuditReopenAfterFailedRotate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "audit.jsonl")
+	a, err := openAuditLog(auditConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	os.RemoveAll(dir)
+	a.mu.Lock()
+	err = a.rotate()
+	a.mu.Unlock()
+	if err == nil {
+		t.Fatal("rotate without the directory did not report the reopen failure")
+	}
+	a.Write(AuditRecord{EventID: "dropped"})
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	a.Write(AuditRecord{EventID: "kept"})
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"kept"`) || strings.Contains(string(b), `"dropped"`) {
+		t.Errorf("audit log after the directory came back = %q", b)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+)
+
+// Ban is a pubkey blocked by a moderator action. It is kept until it is
+// removed, the relay's block list does not need to know about it. A ban
+// with ExpiresAt set is a timeout and is lifted on its own.
+type Ban struct {
+	Pubkey     string        `json:"pubkey"`
+	Moderator  string        `json:"moderator"`
+	Reason     string        `json:"reason"`
+	ModEventID string        `json:"mod_event_id,omitempty"` // the report or reaction
+	CreatedAt  time.Time     `json:"created_at"`
+	ExpiresAt  policy.Expiry `json:"expires_at"`
+}
+
+// lasts reports whether the ban outlasts other
+func (ban Ban) lasts(other Ban) bool {
+	if ban.ExpiresAt.IsZero() {
+		return !other.ExpiresAt.IsZero()
+	}
+	return !other.ExpiresAt.IsZero() && ban.ExpiresAt.After(other.ExpiresAt.Time)
+}
+
+// Bans is the local ban list filled by mod actions, by hex pubkey. It is
+// saved to the state db when there is one.
+type Bans struct {
+	mu    sync.RWMutex
+	m     map[string]Ban
+	store *Store
+}
+
+// bans is the ban list mod actions add to, set up in main
+var bans *Bans
+
+func newBans(s *Store) *Bans {
+	b := &Bans{m: make(map[string]Ban), store: s}
+	if s == nil {
+		return b
+	}
+	now := time.Now()
+	var expired []string
+	err := s.each(banBucket, func(k, v []byte) error {
+		var ban Ban
+		if err := json.Unmarshal(v, &ban); err != nil {
+			log(fmt.Sprintf("error loading ban %s: %s", k, err.Error()))
+			return nil
+		}
+		if ban.ExpiresAt.Expired(now) {
+			expired = append(expired, ban.Pubkey)
+			return nil
+		}
+		b.m[ban.Pubkey] = ban
+		return nil
+	})
+	if err != nil {
+		log(fmt.Sprintf("error loading bans: %s", err.Error()))
+	}
+	for _, pubkey := range expired {
+		s.delete(banBucket, []byte(pubkey))
+	}
+	if len(b.m) > 0 {
+		log(fmt.Sprintf("loaded %d banned pubkeys", len(b.m)))
+	}
+	return b
+}
+
+// Add bans a pubkey, reporting whether the ban was stored. A pubkey that is
+// already banned keeps its ban unless the new one lasts longer.
+func (b *Bans) Add(ban Ban) (bool, error) {
+	ban.Pubkey = policy.DecodePub(ban.Pubkey)
+	if !validPubkey(ban.Pubkey) {
+		return false, fmt.Errorf("%q is not a hex pubkey or npub", ban.Pubkey)
+	}
+	if ban.CreatedAt.IsZero() {
+		ban.CreatedAt = time.Now().UTC()
+	}
+	b.mu.Lock()
+	if old, ok := b.m[ban.Pubkey]; ok && !old.ExpiresAt.Expired(time.Now()) && !ban.lasts(old) {
+		b.mu.Unlock()
+		return false, nil
+	}
+	b.m[ban.Pubkey] = ban
+	b.mu.Unlock()
+	if b.store != nil {
+		return true, b.store.put(banBucket, []byte(ban.Pubkey), ban)
+	}
+	return true, nil
+}
+
+// Remove lifts the ban on pubkey, reporting whether there was one
+func (b *Bans) Remove(pubkey string) (bool, error) {
+	pubkey = policy.DecodePub(pubkey)
+	b.mu.Lock()
+	_, ok := b.m[pubkey]
+	delete(b.m, pubkey)
+	b.mu.Unlock()
+	if ok && b.store != nil {
+		return ok, b.store.delete(banBucket, []byte(pubkey))
+	}
+	return ok, nil
+}
+
+func (b *Bans) Get(pubkey string) (Ban, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	ban, ok := b.m[pubkey]
+	if !ok || ban.ExpiresAt.Expired(time.Now()) {
+		return Ban{}, false
+	}
+	return ban, true
+}
+
+// FindByModEvent returns the ban made by the given report or reaction
+func (b *Bans) FindByModEvent(id string) (Ban, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	now := time.Now()
+	for _, ban := range b.m {
+		if ban.ModEventID == id && !ban.ExpiresAt.Expired(now) {
+			return ban, true
+		}
+	}
+	return Ban{}, false
+}
+
+// List returns the bans, oldest first
+func (b *Bans) List() []Ban {
+	b.mu.RLock()
+	now := time.Now()
+	list := make([]Ban, 0, len(b.m))
+	for _, ban := range b.m {
+		if !ban.ExpiresAt.Expired(now) {
+			list = append(list, ban)
+		}
+	}
+	b.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// BanRule rejects pubkeys banned or timed out by a moderator, next to the
+// relay's block list
+type BanRule struct {
+	bans *Bans
+}
+
+func NewBanRule(b *Bans) *BanRule {
+	return &BanRule{bans: b}
+}
+
+func (*BanRule) Name() string { return "mod_ban" }
+
+func (r *BanRule) Evaluate(ev *policy.Evaluation) {
+	ban, ok := r.bans.Get(ev.Event.Event.Pubkey)
+	if !ok {
+		return
+	}
+	if !ban.ExpiresAt.IsZero() {
+		ev.Logf("rejecting for mod timeout: %s", ban.Pubkey)
+		ev.Reject(r.Name(), "restricted: timed out until "+ban.ExpiresAt.UTC().Format(time.RFC3339)+" reason: "+ban.Reason)
+		return
+	}
+	ev.Logf("rejecting for mod ban: %s", ban.Pubkey)
+	ev.Reject(r.Name(), "blocked: banned by a moderator reason: "+ban.Reason)
+}
+
+// UnbanRule lets moderators undo a ban from a client: a reaction with the
+// unban emoji on a pubkey, or a kind 5 deletion of their own 🔨 reaction or
+// 1984 report. Like other mod actions it is not published.
+type UnbanRule struct {
+	bans     *Bans
+	reaction string
+}
+
+func NewUnbanRule(b *Bans, reaction string) *UnbanRule {
+	return &UnbanRule{bans: b, reaction: reaction}
+}
+
+func (*UnbanRule) Name() string { return "mod_unban" }
+
+// banned reports whether pubkey is banned here or on the relay block list
+func (r *UnbanRule) banned(relay *policy.Relay, pubkey string) bool {
+	if _, ok := r.bans.Get(pubkey); ok {
+		return true
+	}
+	for _, p := range relayPubkeys(relay, false) {
+		if policy.DecodePub(p.Pubkey) == pubkey {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *UnbanRule) Evaluate(ev *policy.Evaluation) {
+	e := ev.Event.Event
+	isReaction := e.Kind == 7 && r.reaction != "" && e.Content == r.reaction
+	if !isReaction && e.Kind != 5 {
+		return
+	}
+	if !policy.IsModAction(*ev.Relay, ev.Event) {
+		return
+	}
+
+	var pubkey, retracted string
+	for _, x := range e.Tags {
+		if len(x) < 2 {
+			continue
+		}
+		if isReaction && x[0] == "p" && r.banned(ev.Relay, x[1]) {
+			pubkey = x[1]
+		}
+		if e.Kind == 5 && x[0] == "e" {
+			// only bans this moderator made can be retracted
+			if ban, ok := r.bans.FindByModEvent(x[1]); ok && ban.Moderator == e.Pubkey {
+				pubkey, retracted = ban.Pubkey, x[1]
+			}
+		}
+	}
+	if pubkey == "" {
+		// an ordinary reaction or deletion
+		return
+	}
+
+	reason := "mod action by " + e.Pubkey + ": unban pubkey"
+	if retracted != "" {
+		reason = "mod action by " + e.Pubkey + ": retracted " + retracted
+	}
+	ev.Finish(policy.Decision{
+		Action: policy.ActionShadowReject,
+		Rule:   r.Name(),
+		ModAction: &policy.ModAction{
+			Action:     "unbanPubkey",
+			Pubkey:     pubkey,
+			Moderator:  e.Pubkey,
+			Reason:     reason,
+			ModEventID: e.ID,
+		},
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+	"github.com/spf13/viper"
+)
+
+// community report settings from .spamblaster.env
+type communityConfig struct {
+	Enabled           bool    `mapstructure:"COMMUNITY_REPORTS"`
+	WindowSeconds     int     `mapstructure:"COMMUNITY_WINDOW_SECONDS"`     // reports older than this do not count
+	EventThreshold    float64 `mapstructure:"COMMUNITY_EVENT_THRESHOLD"`    // report weight that hides an event, 0 never
+	PubkeyThreshold   float64 `mapstructure:"COMMUNITY_PUBKEY_THRESHOLD"`   // report weight that quarantines a pubkey, 0 never
+	QuarantineSeconds int     `mapstructure:"COMMUNITY_QUARANTINE_SECONDS"` // how long a quarantine lasts
+	SourceWeights     string  `mapstructure:"COMMUNITY_SOURCE_WEIGHTS"`     // acl source=weight pairs, comma separated
+}
+
+func setCommunityDefaults() {
+	viper.SetDefault("COMMUNITY_REPORTS", false)
+	viper.SetDefault("COMMUNITY_WINDOW_SECONDS", 86400)
+	viper.SetDefault("COMMUNITY_EVENT_THRESHOLD", 3)
+	viper.SetDefault("COMMUNITY_PUBKEY_THRESHOLD", 5)
+	viper.SetDefault("COMMUNITY_QUARANTINE_SECONDS", 86400)
+	viper.SetDefault("COMMUNITY_SOURCE_WEIGHTS", "")
+}
+
+// parseSourceWeights reads "relay=2,<acl source id>=0.5". Sources not
+// listed weigh 1.
+func parseSourceWeights(s string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		source, w, found := strings.Cut(pair, "=")
+		weight, err := strconv.ParseFloat(strings.TrimSpace(w), 64)
+		if !found || err != nil || weight < 0 {
+			return nil, fmt.Errorf("COMMUNITY_SOURCE_WEIGHTS: %q is not source=weight", pair)
+		}
+		weights[strings.TrimSpace(source)] = weight
+	}
+	return weights, nil
+}
+
+// communityModerator is the moderator community actions are recorded by
+const communityModerator = "community"
+
+type communityReport struct {
+	at     time.Time
+	weight float64
+}
+
+// reportTally holds the reports against one event or pubkey by reporter,
+// so a reporter counts once however often they report
+type reportTally struct {
+	reports   map[string]communityReport
+	triggered bool
+}
+
+// weight is the total weight of the reports inside the window
+func (t *reportTally) weight(now time.Time, window time.Duration) float64 {
+	total := 0.0
+	for reporter, r := range t.reports {
+		if now.Sub(r.at) > window {
+			delete(t.reports, reporter)
+			continue
+		}
+		total += r.weight
+	}
+	return total
+}
+
+// CommunityReportRule counts kind 1984 reports from trusted members, those
+// in the ACL, and hides the event or quarantines the pubkey when enough of
+// them agree inside the window. Reports are published as usual.
+type CommunityReportRule struct {
+	cfg     communityConfig
+	weights map[string]float64
+
+	mu      sync.Mutex
+	events  map[string]*reportTally
+	pubkeys map[string]*reportTally
+	inserts int
+}
+
+func NewCommunityReportRule(cfg communityConfig) (*CommunityReportRule, error) {
+	weights, err := parseSourceWeights(cfg.SourceWeights)
+	if err != nil {
+		return nil, err
+	}
+	return &CommunityReportRule{
+		cfg:     cfg,
+		weights: weights,
+		events:  make(map[string]*reportTally),
+		pubkeys: make(map[string]*reportTally),
+	}, nil
+}
+
+func (*CommunityReportRule) Name() string { return "community_reports" }
+
+func (r *CommunityReportRule) Evaluate(ev *policy.Evaluation) {
+	e := ev.Event.Event
+	if e.Kind != 1984 || !ev.Allow || ev.DryRun {
+		return
+	}
+	source, ok := ev.ACL.Source(e.Pubkey)
+	if !ok {
+		return
+	}
+	weight, ok := r.weights[source]
+	if !ok {
+		weight = 1
+	}
+	if weight == 0 {
+		return
+	}
+
+	var eventID, pubkey, reportType string
+	for _, x := range e.Tags {
+		if len(x) < 2 {
+			continue
+		}
+		if x[0] == "e" && eventID == "" {
+			eventID = x[1]
+			if len(x) >= 3 {
+				reportType = x[2]
+			}
+		}
+		if x[0] == "p" && pubkey == "" {
+			pubkey = policy.DecodePub(x[1])
+			if len(x) >= 3 && reportType == "" {
+				reportType = x[2]
+			}
+		}
+	}
+	if pubkey != "" && policy.IsModerator(*ev.Relay, pubkey) {
+		// reports against the moderators, or their events, do not count
+		ev.Logf("community reports: ignoring report of moderator %s", pubkey)
+		return
+	}
+	if pubkey == e.Pubkey {
+		// reporting yourself does not count
+		pubkey = ""
+	}
+
+	now := time.Now()
+	window := time.Duration(r.cfg.WindowSeconds) * time.Second
+	report := communityReport{at: now, weight: weight}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inserts++
+	if r.inserts%1000 == 0 {
+		r.sweep(now, window)
+	}
+
+	if eventID != "" && r.cfg.EventThreshold > 0 {
+		t := r.tally(r.events, eventID)
+		t.reports[e.Pubkey] = report
+		if total := t.weight(now, window); total >= r.cfg.EventThreshold && !t.triggered {
+			t.triggered = true
+			ev.Logf("community reports: hiding event %s, weight %.1f from %d reporters", eventID, total, len(t.reports))
+			ev.Trigger(policy.ModAction{
+				Action:     "hideEvent",
+				EventID:    eventID,
+				Pubkey:     pubkey,
+				Moderator:  communityModerator,
+				Reason:     fmt.Sprintf("community reports: %.1f weight from %d reporters, last report %s", total, len(t.reports), reportType),
+				ModEventID: e.ID,
+			})
+		}
+	}
+
+	if pubkey != "" && r.cfg.PubkeyThreshold > 0 {
+		t := r.tally(r.pubkeys, pubkey)
+		t.reports[e.Pubkey] = report
+		if total := t.weight(now, window); total >= r.cfg.PubkeyThreshold && !t.triggered {
+			t.triggered = true
+			ev.Logf("community reports: quarantining pubkey %s, weight %.1f from %d reporters", pubkey, total, len(t.reports))
+			ev.Trigger(policy.ModAction{
+				Action:          "timeoutPubkey",
+				Pubkey:          pubkey,
+				Moderator:       communityModerator,
+				Reason:          fmt.Sprintf("community reports: %.1f weight from %d reporters, last report %s", total, len(t.reports), reportType),
+				ModEventID:      e.ID,
+				DurationSeconds: r.cfg.QuarantineSeconds,
+			})
+		}
+	}
+}
+
+func (r *CommunityReportRule) tally(m map[string]*reportTally, key string) *reportTally {
+	t, ok := m[key]
+	if !ok {
+		t = &reportTally{reports: make(map[string]communityReport)}
+		m[key] = t
+	}
+	return t
+}
+
+// sweep drops targets without reports inside the window. A target that was
+// acted on can be acted on again once its reports have expired.
+func (r *CommunityReportRule) sweep(now time.Time, window time.Duration) {
+	for _, m := range []map[string]*reportTally{r.events, r.pubkeys} {
+		for key, t := range m {
+			if t.weight(now, window) == 0 {
+				delete(m, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jeremyd/spamblaster/policy"
+)
+
+func communityReport1984(reporter, eventID, author string) policy.StrfryEvent {
+	var e policy.StrfryEvent
+	e.Type = "new"
+	e.Event.ID = strings.Repeat("1", 64)
+	e.Event.Kind = 1984
+	e.Event.Pubkey = reporter
+	e.Event.Tags = [][]string{{"e", eventID, "spam"}, {"p", author, "spam"}}
+	return e
+}
+
+func TestCommunityReportsIgnoreModerators(t *testing.T) {
+	owner := strings.Repeat("0a", 32)
+	reporter := strings.Repeat("0b", 32)
+	author := strings.Repeat("0c", 32)
+	eventID := strings.Repeat("0d", 32)
+
+	relay := policy.Relay{ID: "r1", DefaultMessagePolicy: true}
+	relay.Owner.Pubkey = owner
+	acl := policy.MapACL{reporter: "relay"}
+
+	rule, err := NewCommunityReportRule(communityConfig{Enabled: true, WindowSeconds: 3600, EventThreshold: 1, PubkeyThreshold: 1, QuarantineSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := policy.NewPolicy(rule)
+
+	d := p.Decide(communityReport1984(reporter, eventID, owner), relay, acl)
+	if d.Action != policy.ActionAccept {
+		t.Fatalf("report was %s, want accept", d.Action)
+	}
+	if len(d.Triggered) != 0 {
+		t.Errorf("report of the owner's event triggered %+v", d.Triggered)
+	}
+
+	d = p.Decide(communityReport1984(reporter, eventID, author), relay, acl)
+	var actions []string
+	for _, a := range d.Triggered {
+		actions = append(actions, a.Action)
+	}
+	if strings.Join(actions, ",") != "hideEvent,timeoutPubkey" {
+		t.Errorf("report of a member's event triggered %v, want hideEvent and timeoutPubkey", actions)
+	}
+}
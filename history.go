@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// HistoryEntry is one moderation action, kept so moderators can see who
+// did what and why
+type HistoryEntry struct {
+	ID         uint64    `json:"id"`
+	At         time.Time `json:"at"`
+	Action     string    `json:"action"` // ModAction action or NIP-86 method
+	Moderator  string    `json:"moderator"`
+	Pubkey     string    `json:"pubkey,omitempty"`
+	EventID    string    `json:"event_id,omitempty"`
+	ModEventID string    `json:"mod_event_id,omitempty"` // the report, reaction or deletion
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// ModHistory keeps every moderation action in the state db, and the most
+// recent ones in memory for the admin API
+type ModHistory struct {
+	mu      sync.RWMutex
+	entries []HistoryEntry
+	seq     uint64
+	store   *Store
+}
+
+// history records moderation actions, set up in main
+var history *ModHistory
+
+const historyKeep = 10000
+
+func newModHistory(s *Store) *ModHistory {
+	h := &ModHistory{store: s}
+	if s == nil {
+		return h
+	}
+	err := s.each(historyBucket, func(k, v []byte) error {
+		var e HistoryEntry
+		if err := json.Unmarshal(v, &e); err != nil {
+			return nil
+		}
+		h.entries = append(h.entries, e)
+		if len(h.entries) > historyKeep {
+			h.entries = h.entries[1:]
+		}
+		h.seq = max(h.seq, e.ID)
+		return nil
+	})
+	if err != nil {
+		log(fmt.Sprintf("error loading moderation history: %s", err.Error()))
+	}
+	return h
+}
+
+func (h *ModHistory) Record(e HistoryEntry) {
+	h.mu.Lock()
+	h.seq++
+	e.ID = h.seq
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+	h.entries = append(h.entries, e)
+	if len(h.entries) > historyKeep {
+		h.entries = h.entries[len(h.entries)-historyKeep:]
+	}
+	h.mu.Unlock()
+	if h.store != nil {
+		if err := h.store.put(historyBucket, seqKey(e.ID), e); err != nil {
+			log(fmt.Sprintf("error saving moderation history: %s", err.Error()))
+		}
+	}
+}
+
+// List returns up to limit recent entries, newest first, only those about
+// pubkey when it is set
+func (h *ModHistory) List(pubkey string, limit int) []HistoryEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	list := []HistoryEntry{}
+	for i := len(h.entries) - 1; i >= 0 && len(list) < limit; i-- {
+		if pubkey == "" || h.entries[i].Pubkey == pubkey {
+			list = append(list, h.entries[i])
+		}
+	}
+	return list
+}
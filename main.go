@@ -6,135 +6,17 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
-	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/jeremyd/spamblaster/policy"
 	"github.com/nbd-wtf/go-nostr/nip19"
 	"github.com/spf13/viper"
 )
 
-// Strfry Events (FROM STDIN)
-type StrfryEvent struct {
-	Event struct {
-		Content   string     `json:"content"`
-		CreatedAt int        `json:"created_at"`
-		ID        string     `json:"id"`
-		Kind      int        `json:"kind"`
-		Pubkey    string     `json:"pubkey"`
-		Sig       string     `json:"sig"`
-		Tags      [][]string `json:"tags"`
-	} `json:"event"`
-	ReceivedAt int    `json:"receivedAt"`
-	SourceInfo string `json:"sourceInfo"`
-	SourceType string `json:"sourceType"`
-	Type       string `json:"type"`
-}
-
-// Strfry Actions
-type StrfryResult struct {
-	ID     string `json:"id"`     // event id
-	Action string `json:"action"` // accept or reject
-	Msg    string `json:"msg"`    // sent to client for reject
-}
-
-// Relay Creator Schema
-type Relay struct {
-	ID                   string `json:"id"`
-	Name                 string `json:"name"`
-	OwnerID              string `json:"ownerId"`
-	DefaultMessagePolicy bool   `json:"default_message_policy"`
-	AllowGiftwrap        bool   `json:"allow_giftwrap"`
-	AllowTagged          bool   `json:"allow_tagged"`
-	AllowKeywordPubkey   bool   `json:"allow_keyword_pubkey"`
-	UseWoaForTagged      bool   `json:"use_woa_for_tagged"`
-	AllowList            struct {
-		ID           string `json:"id"`
-		RelayID      string `json:"relayId"`
-		ListKeywords []struct {
-			ID          string      `json:"id"`
-			AllowListID string      `json:"AllowListId"`
-			BlockListID interface{} `json:"BlockListId"`
-			Keyword     string      `json:"keyword"`
-			Reason      string      `json:"reason"`
-			ExpiresAt   interface{} `json:"expires_at"`
-		} `json:"list_keywords"`
-		ListPubkeys []ListPubkey `json:"list_pubkeys"`
-		ListKinds   []struct {
-			ID          string      `json:"id"`
-			AllowListID string      `json:"AllowListId"`
-			BlockListID interface{} `json:"BlockListId"`
-			Kind        int         `json:"kind"`
-			Reason      string      `json:"reason"`
-		} `json:"list_kinds"`
-	} `json:"allow_list"`
-	BlockList struct {
-		ID           string `json:"id"`
-		RelayID      string `json:"relayId"`
-		ListKeywords []struct {
-			ID          string      `json:"id"`
-			AllowListID interface{} `json:"AllowListId"`
-			BlockListID string      `json:"BlockListId"`
-			Keyword     string      `json:"keyword"`
-			Reason      string      `json:"reason"`
-			ExpiresAt   interface{} `json:"expires_at"`
-		} `json:"list_keywords"`
-		ListPubkeys []struct {
-			ID          string      `json:"id"`
-			AllowListID interface{} `json:"AllowListId"`
-			BlockListID string      `json:"BlockListId"`
-			Pubkey      string      `json:"pubkey"`
-			Reason      string      `json:"reason"`
-			ExpiresAt   interface{} `json:"expires_at"`
-		} `json:"list_pubkeys"`
-		ListKinds []struct {
-			ID          string      `json:"id"`
-			AllowListID string      `json:"AllowListId"`
-			BlockListID interface{} `json:"BlockListId"`
-			Kind        int         `json:"kind"`
-			Reason      string      `json:"reason"`
-		} `json:"list_kinds"`
-	} `json:"block_list"`
-	Owner struct {
-		ID     string      `json:"id"`
-		Pubkey string      `json:"pubkey"`
-		Name   interface{} `json:"name"`
-	} `json:"owner"`
-
-	Moderators []struct {
-		ID      string `json:"id"`
-		RelayID string `json:"relayId"`
-		UserID  string `json:"userId"`
-		User    struct {
-			Pubkey string `json:"pubkey"`
-		} `json:"user"`
-	} `json:"moderators"`
-
-	AclSources []AclSource `json:"acl_sources"`
-}
-
-type ListPubkey struct {
-	ID          string      `json:"id"`
-	AllowListID string      `json:"AllowListId"`
-	BlockListID interface{} `json:"BlockListId"`
-	Pubkey      string      `json:"pubkey"`
-	Reason      string      `json:"reason"`
-	ExpiresAt   interface{} `json:"expires_at"`
-}
-
-type AclSource struct {
-	ID      string `json:"id"`
-	RelayID string `json:"relayId"`
-	AclType string `json:"aclType"`
-	Url     string `json:"url"`
-}
-
 type GrapevineACL struct {
 	Success bool `json:"success"`
 	Data    struct {
@@ -153,6 +35,9 @@ var logfile *os.File
 var errlog = bufio.NewWriter(os.Stderr)
 var pubkeyMap sync.Map
 
+// local state db, nil when STATE_DB is empty or could not be opened
+var store *Store
+
 // strfry was not passing through the logs, but now it seems to work.
 // an intermittant logging problem that does not affect the rest of the operations
 // logging to a file can be helpful in this case (disabled)
@@ -184,19 +69,9 @@ func log(message string) {
 	//}
 }
 
-func decodePub(pubkey string) string {
-	usepub := pubkey
-	if strings.Contains(pubkey, "npub") {
-		if _, v, err := nip19.Decode(pubkey); err == nil {
-			usepub = v.(string)
-		}
-	}
-	return usepub
-}
+func queryRelay(apiURL string, oldrelay policy.Relay) (policy.Relay, error) {
 
-func queryRelay(apiURL string, oldrelay Relay) (Relay, error) {
-
-	relay := Relay{}
+	relay := policy.Relay{}
 
 	req, err := http.NewRequest(http.MethodGet, apiURL, nil)
 
@@ -207,11 +82,15 @@ func queryRelay(apiURL string, oldrelay Relay) (Relay, error) {
 	res, getErr := client.Do(req)
 	if getErr != nil {
 		log(getErr.Error())
-		return oldrelay, err
+		return oldrelay, getErr
 	}
 	if res.Body != nil {
 		defer res.Body.Close()
 	}
+	// an error page would unmarshal into an empty relay
+	if res.StatusCode != http.StatusOK {
+		return oldrelay, fmt.Errorf("relay config status code error: %d", res.StatusCode)
+	}
 
 	body, readErr := io.ReadAll(res.Body)
 	if readErr != nil {
@@ -227,7 +106,7 @@ func queryRelay(apiURL string, oldrelay Relay) (Relay, error) {
 	return relay, nil
 }
 
-func fetchGrapevine(aclSource AclSource, m *sync.Map) bool {
+func fetchGrapevine(aclSource policy.AclSource, m *sync.Map) bool {
 	// Set a timeout for the HTTP request
 	client := &http.Client{
 		Timeout: 240 * time.Second,
@@ -266,7 +145,7 @@ func fetchGrapevine(aclSource AclSource, m *sync.Map) bool {
 	return true
 }
 
-func fetchNip05(aclSource AclSource, m *sync.Map) bool {
+func fetchNip05(aclSource policy.AclSource, m *sync.Map) bool {
 	log(fmt.Sprintf("Fetching NIP05 Domain ACL from: %s", aclSource.Url))
 
 	// Ensure the URL ends with /.well-known/nostr.json
@@ -317,6 +196,33 @@ func fetchNip05(aclSource AclSource, m *sync.Map) bool {
 	return true
 }
 
+// fetchAcl fetches an acl source by type, records the result and saves
+// the new pubkey set
+func fetchAcl(as policy.AclSource, m *sync.Map) bool {
+	start := time.Now()
+	var ok bool
+	if as.AclType == "grapevine" || as.AclType == "brainstorm" {
+		ok = fetchGrapevine(as, m)
+	} else if as.AclType == "nip05" {
+		ok = fetchNip05(as, m)
+	} else {
+		log("unknown type" + as.AclType)
+		return false
+	}
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	if ok && store != nil {
+		store.saveAclFromMap(as.ID, m)
+	}
+	publishACL(m)
+	recordAclFetch(as, ok, start, m)
+	aclFetchTotal.WithLabelValues(as.AclType, result).Inc()
+	aclFetchDuration.WithLabelValues(as.AclType).Observe(time.Since(start).Seconds())
+	return ok
+}
+
 func updateSyncMapFromNip05(np NIP05DomainACL, m *sync.Map, source string) {
 	for _, p := range np.Names {
 		m.LoadOrStore(p, source)
@@ -371,20 +277,6 @@ func updateSyncMapFromGrapevine(gv GrapevineACL, m *sync.Map, source string) {
 	cleanupSyncMapFromGrapevine(gv, m, source)
 }
 
-func isModAction(relay Relay, e StrfryEvent) bool {
-	isModAction := false
-	for _, m := range relay.Moderators {
-		usepub := decodePub(m.User.Pubkey)
-		if usepub == e.Event.Pubkey {
-			isModAction = true
-		}
-	}
-	if relay.Owner.Pubkey == e.Event.Pubkey {
-		isModAction = true
-	}
-	return isModAction
-}
-
 type influxdbConfig struct {
 	Url         string `mapstructure:"INFLUXDB_URL"`
 	Token       string `mapstructure:"INFLUXDB_TOKEN"`
@@ -402,8 +294,47 @@ func mapLen(m *sync.Map) int64 {
 	return counter
 }
 
-func updateSyncMapFromRelay(relay Relay, m *sync.Map) {
+// aclSnapshot is the copy of pubkeyMap that events are decided against, so
+// a decision never sees an acl source half way through an update
+var aclSnapshot atomic.Pointer[policy.MapACL]
+var aclSnapshotMu sync.Mutex
+
+// publishACL copies m into the ACL snapshot, call it after changing m
+func publishACL(m *sync.Map) {
+	aclSnapshotMu.Lock()
+	defer aclSnapshotMu.Unlock()
+	acl := make(policy.MapACL)
+	m.Range(func(k, v interface{}) bool {
+		pubkey, _ := k.(string)
+		source, _ := v.(string)
+		acl[pubkey] = source
+		return true
+	})
+	aclSnapshot.Store(&acl)
+}
+
+// currentACL returns the latest ACL snapshot
+func currentACL() policy.ACL {
+	if acl := aclSnapshot.Load(); acl != nil {
+		return *acl
+	}
+	return policy.MapACL{}
+}
+
+// prepareRelay precompiles a newly loaded relay config, logging the
+// entries that cannot be used
+func prepareRelay(relay *policy.Relay) {
+	if err := relay.Prepare(); err != nil {
+		log(fmt.Sprintf("relay config: %s", err.Error()))
+	}
+}
+
+func updateSyncMapFromRelay(relay policy.Relay, m *sync.Map) {
+	now := time.Now()
 	for _, p := range relay.AllowList.ListPubkeys {
+		if p.ExpiresAt.Expired(now) {
+			continue
+		}
 		// legacy, sometimes they're not in hex here
 		usekey := p.Pubkey
 		if strings.Contains(p.Pubkey, "npub") {
@@ -423,13 +354,15 @@ func updateSyncMapFromRelay(relay Relay, m *sync.Map) {
 	}
 
 	cleanupSyncMapFromRelay(relay, m)
+	publishACL(m)
 	log(fmt.Sprintf("mapLen size is: %d", mapLen(m)))
 	log(fmt.Sprintf("lp size is: %d", len(relay.AllowList.ListPubkeys)))
 	//doubleCheckAllKeysExist(relay.AllowList.ListPubkeys, m)
 }
 
-func cleanupSyncMapFromRelay(relay Relay, m *sync.Map) {
+func cleanupSyncMapFromRelay(relay policy.Relay, m *sync.Map) {
 	lp := relay.AllowList.ListPubkeys
+	now := time.Now()
 	m.Range(func(k, v interface{}) bool {
 		if k == relay.Owner.Pubkey {
 			return true
@@ -444,6 +377,9 @@ func cleanupSyncMapFromRelay(relay Relay, m *sync.Map) {
 		}
 		notfound := true
 		for _, i := range lp {
+			if i.ExpiresAt.Expired(now) {
+				continue
+			}
 			usekey := i.Pubkey
 			if strings.Contains(i.Pubkey, "npub") {
 				if _, v, err := nip19.Decode(i.Pubkey); err == nil {
@@ -465,7 +401,7 @@ func cleanupSyncMapFromRelay(relay Relay, m *sync.Map) {
 	})
 }
 
-func doubleCheckAllKeysExist(lp []ListPubkey, m *sync.Map) {
+func doubleCheckAllKeysExist(lp []policy.ListPubkey, m *sync.Map) {
 
 	for _, i := range lp {
 		usekey := i.Pubkey
@@ -497,8 +433,7 @@ func main() {
 		log("Logging initialized successfully")
 	}
 
-	var err1 error
-	var relay Relay
+	var currentRelay atomic.Pointer[policy.Relay]
 
 	// InfluxDB and PRIVATE_KEY config file
 	viper.AddConfigPath("/usr/local/etc")
@@ -506,80 +441,178 @@ func main() {
 	viper.AddConfigPath(".")
 	viper.SetConfigName(".spamblaster.env")
 	viper.SetConfigType("env")
-	influxEnabled := false
-	var iConfig *influxdbConfig
+	var sConfig spamConfig
+	var nConfig normalizeConfig
+	var aConfig auditConfig
+	var fConfig strfryConfig
+	var rConfig reportConfig
+	var cConfig communityConfig
+	var tConfig timeoutConfig
+	setSpamDefaults()
+	setNormalizeDefaults()
+	setAuditDefaults()
+	setStrfryDefaults()
+	setReportDefaults()
+	setCommunityDefaults()
+	setTimeoutDefaults()
+	viper.SetDefault("STATE_DB", "/srv/strfry/spamblaster.db")
+	viper.SetDefault("RELAY_CONFIG_POLL_SECONDS", 10)
+	viper.SetDefault("UPSTREAM_MOD_ACTIONS", true)
+	viper.SetDefault("MOD_UNBAN_REACTION", "✅")
 
 	if err := viper.ReadInConfig(); err != nil {
 		log(fmt.Sprint("Warn: error reading .spamblaster.env main config file from /srv/strfry/, /usr/local/etc, ./\n", err))
 		os.Exit(1)
 	}
 
-	// Viper unmarshals the loaded env variables into the struct
-	if err := viper.Unmarshal(&iConfig); err != nil {
-		log("could not unmarshal influxdb parts of config?!")
+	if err := viper.Unmarshal(&sConfig); err != nil {
+		log("could not unmarshal spam filter parts of config?!")
 	}
 
-	if iConfig.Token != "" || iConfig.Url != "" || iConfig.Bucket != "" {
-		influxEnabled = true
-	} else {
-		log("Warn: influxdb is disabled\n")
+	if err := viper.Unmarshal(&nConfig); err != nil {
+		log("could not unmarshal normalize parts of config?!")
 	}
 
-	pkey := viper.GetString("PRIVATE_KEY")
-
-	log(fmt.Sprintf("Info: influxdb: %t\n", influxEnabled))
+	if err := viper.Unmarshal(&aConfig); err != nil {
+		log("could not unmarshal audit log parts of config?!")
+	}
 
-	// example spamblaster config
-	apiURL := "http://127.0.0.1:3000/api/sconfig/relays/clkklcjon000wgh31mcgbut40"
+	if err := viper.Unmarshal(&fConfig); err != nil {
+		log("could not unmarshal strfry parts of config?!")
+	}
+	deleter = newStrfryDeleter(fConfig)
+	deleter.Start()
 
-	body, err := os.ReadFile("./spamblaster.cfg")
+	if err := viper.Unmarshal(&rConfig); err != nil {
+		log("could not unmarshal report parts of config?!")
+	}
+	reports, err := policy.NewReportPolicy(policy.ReportConfig{
+		Actions:        rConfig.Actions,
+		DefaultAction:  rConfig.DefaultAction,
+		TimeoutSeconds: rConfig.TimeoutSeconds,
+	})
 	if err != nil {
-		log(fmt.Sprintf("unable to read config file: %v", err))
-	} else {
-		apiURL = strings.TrimSuffix(string(body), "\n")
+		log(fmt.Sprintf("Warn: %v, every report deletes the event", err))
 	}
 
-	base, err := url.Parse(apiURL)
-	if err != nil {
-		log(fmt.Sprintf("error parsing apiURL: %v", err))
+	if err := viper.Unmarshal(&tConfig); err != nil {
+		log("could not unmarshal timeout parts of config?!")
 	}
 
-	baseURL := &url.URL{
-		Scheme: base.Scheme,
-		Host:   base.Host,
+	var audit *auditLog
+	if aConfig.Path != "" {
+		var err error
+		audit, err = openAuditLog(aConfig)
+		if err != nil {
+			log(fmt.Sprintf("Warn: could not open audit log %s: %v", aConfig.Path, err))
+		} else {
+			defer audit.Close()
+		}
+	}
+
+	if metricsListen := viper.GetString("METRICS_LISTEN"); metricsListen != "" {
+		serveMetrics(metricsListen, &pubkeyMap)
 	}
 
-	ev := signEventWithLoginToken(baseURL.String(), pkey)
-	csrf := getCSRF(baseURL.String())
-	performLogin(baseURL.String(), ev, csrf)
+	log(fmt.Sprintf("Info: spam filter: %t\n", sConfig.Enabled))
 
-	relay, err1 = queryRelay(apiURL, relay)
+	// API URL, PRIVATE_KEY and influxdb can be reloaded
+	active = loadSettings()
+	defer func() {
+		if s := currentSettings(); s.influx != nil {
+			s.influx.Close()
+		}
+	}()
+
+	// load the last good config and acls first, so decisions can be made
+	// even when the API is down
+	var relay policy.Relay
+	// the config version last saved, the config is only written when it
+	// changes
+	var savedVersion string
+	// when the fetch time was last written, at most once a minute
+	var savedFetched time.Time
+	if statePath := viper.GetString("STATE_DB"); statePath != "" {
+		var err error
+		store, err = openStore(statePath)
+		if err != nil {
+			log(fmt.Sprintf("Warn: could not open state db %s: %v", statePath, err))
+		} else {
+			defer store.Close()
+			relay, _ = store.restore(&pubkeyMap)
+			prepareRelay(&relay)
+			savedVersion = relay.Version()
+		}
+	}
+	saveRelay := func(relay policy.Relay) {
+		if store == nil {
+			return
+		}
+		if relay.Version() != savedVersion {
+			if err := store.SaveRelay(relay); err != nil {
+				log(fmt.Sprintf("error saving relay config: %s", err.Error()))
+				return
+			}
+			savedVersion = relay.Version()
+		}
+		if now := time.Now(); now.Sub(savedFetched) >= time.Minute {
+			if err := store.SaveRelayFetched(now); err != nil {
+				log(fmt.Sprintf("error saving relay fetch time: %s", err.Error()))
+				return
+			}
+			savedFetched = now
+		}
+	}
+
+	overrides := newOverrides(store)
+	managed = newManagedLists(store)
+	bans = newBans(store)
+	history = newModHistory(store)
+	outbox = newOutbox(store)
+	outbox.Start()
+	upstreamModActions = viper.GetBool("UPSTREAM_MOD_ACTIONS")
+
+	active.login()
+
+	relay, err1 := fetchRelayConfig(active, relay)
+	prepareRelay(&relay)
 	if err1 != nil {
 		log("there was an error fetching relay, using cache or nil: " + err1.Error())
 	} else {
-		updateSyncMapFromRelay(relay, &pubkeyMap)
+		lastConfigPoll.Store(time.Now().UnixNano())
+		saveRelay(relay)
 	}
+	updateSyncMapFromRelay(relay, &pubkeyMap)
+	currentRelay.Store(&relay)
 
-	aclListener := make(chan []AclSource)
+	aclListener := make(chan []policy.AclSource)
 
-	ticker := time.NewTicker(60 * time.Second)
+	ticker := time.NewTicker(active.pollInterval())
 	defer ticker.Stop()
 
 	go func() {
 		for {
 			<-ticker.C
-			relay, err1 = queryRelay(apiURL, relay)
-			if err1 != nil {
-				log("there was an error fetching relay, using cache or nil" + err1.Error())
+			s := currentSettings()
+			ticker.Reset(s.pollInterval())
+			relay, err := fetchRelayConfig(s, *currentRelay.Load())
+			if err != nil {
+				log("there was an error fetching relay, using cache or nil" + err.Error())
 			} else {
-				updateSyncMapFromRelay(relay, &pubkeyMap)
+				prepareRelay(&relay)
+				currentRelay.Store(&relay)
+				lastConfigPoll.Store(time.Now().UnixNano())
+				saveRelay(relay)
 			}
+			// refresh even from the cached relay, so expired allow list
+			// pubkeys leave the map on schedule
+			updateSyncMapFromRelay(relay, &pubkeyMap)
 			aclListener <- relay.AclSources
 		}
 	}()
 
 	go func() {
-		var oldAclSources []AclSource
+		var oldAclSources []policy.AclSource
 		var allTimers = make(map[string]*time.Ticker)
 
 		for {
@@ -599,13 +632,7 @@ func main() {
 					if !foundOld {
 						// setup new acl (initial fetch)
 						log(fmt.Sprintf("setting up new %s:%s", as.Url, as.ID))
-						if as.AclType == "grapevine" || as.AclType == "brainstorm" {
-							fetchGrapevine(as, &pubkeyMap)
-						} else if as.AclType == "nip05" {
-							fetchNip05(as, &pubkeyMap)
-						} else {
-							log("unknown type" + as.AclType)
-						}
+						fetchAcl(as, &pubkeyMap)
 
 						// stagger the fetch
 						time.Sleep(time.Second * 30)
@@ -614,18 +641,12 @@ func main() {
 						newTimer := time.NewTicker(60 * time.Minute)
 						allTimers[as.ID] = newTimer
 
-						go func(thisAcl AclSource) {
+						go func(thisAcl policy.AclSource) {
 							for {
 								<-newTimer.C
 
 								// here we kick off a new acl listener
-								if thisAcl.AclType == "grapevine" || thisAcl.AclType == "brainstorm" {
-									fetchGrapevine(thisAcl, &pubkeyMap)
-								} else if thisAcl.AclType == "nip05" {
-									fetchNip05(thisAcl, &pubkeyMap)
-								} else {
-									log("unknown type" + thisAcl.AclType)
-								}
+								fetchAcl(thisAcl, &pubkeyMap)
 							}
 						}(as)
 					}
@@ -643,6 +664,9 @@ func main() {
 						// cleanup
 						log(fmt.Sprintf("cleaning up %s ", o.Url))
 						allTimers[o.ID].Stop()
+						if store != nil {
+							store.DeleteAcl(o.ID)
+						}
 						// TODO cleanup the pubkeyMap
 						counter := 0
 						pubkeyMap.Range(func(key, value any) bool {
@@ -652,6 +676,7 @@ func main() {
 							}
 							return true
 						})
+						publishACL(&pubkeyMap)
 						log(fmt.Sprintf("deleted %d pubkeys from map source removal", counter))
 					}
 				}
@@ -660,312 +685,187 @@ func main() {
 		}
 	}()
 
-	var client influxdb2.Client
-	var writeAPI api.WriteAPI
-
-	if influxEnabled {
-		// INFLUX INIT
-		client = influxdb2.NewClientWithOptions(iConfig.Url, iConfig.Token,
-			influxdb2.DefaultOptions().SetBatchSize(20))
-		// Get non-blocking write client
-		writeAPI = client.WriteAPI(iConfig.Org, iConfig.Bucket)
-	}
-
-	for {
-		var input, _ = reader.ReadString('\n')
-
-		var e StrfryEvent
-		if err := json.Unmarshal([]byte(input), &e); err != nil {
-			panic(err)
+	// the relay lists decide first, these only look at events that are
+	// still allowed
+	pipeline := policy.DefaultPolicy()
+	pipeline.Log = log
+	pipeline.Normalize = nConfig.NormalizeKeywords
+	pipeline.Replace("mod_action", policy.ModActionRule{
+		Reports:  reports,
+		Timeouts: policy.TimeoutConfig{Reaction: tConfig.Reaction, Seconds: tConfig.Seconds, MaxSeconds: tConfig.MaxSeconds},
+	})
+	pipeline.InsertAfter("mod_action", NewUnbanRule(bans, viper.GetString("MOD_UNBAN_REACTION")))
+	pipeline.InsertAfter("allow_pubkey", NewOverrideAllowRule(overrides), NewManagedAllowPubkeyRule(managed))
+	pipeline.InsertAfter("allow_kind", NewManagedAllowKindRule(managed))
+	pipeline.InsertAfter("block_pubkey", NewBanRule(bans))
+	pipeline.InsertAfter("block_kind", NewOverrideRule(overrides), NewManagedListRule(managed))
+	if nConfig.ObfuscationFilter {
+		pipeline.Append(&policy.ObfuscationRule{MaxCombining: nConfig.MaxCombining, MaxInvisible: nConfig.MaxInvisible})
+	}
+	if sConfig.Enabled {
+		pipeline.Append(NewSpamRule(sConfig))
+	}
+	pipeline.Append(NewRateLimitRule(), NewIPRateLimitRule(), NewPowRule())
+	if err := viper.Unmarshal(&cConfig); err != nil {
+		log("could not unmarshal community report parts of config?!")
+	}
+	if cConfig.Enabled {
+		community, err := NewCommunityReportRule(cConfig)
+		if err != nil {
+			log(fmt.Sprintf("Warn: community reports are disabled: %v", err))
+		} else {
+			pipeline.Append(community)
 		}
+	}
+	log(fmt.Sprintf("Info: community reports: %t\n", cConfig.Enabled))
 
-		result := StrfryResult{
-			ID:     e.Event.ID,
-			Action: "accept",
+	if adminListen := viper.GetString("ADMIN_LISTEN"); adminListen != "" {
+		admin := &adminServer{
+			policy:    pipeline,
+			relay:     &currentRelay,
+			pubkeys:   &pubkeyMap,
+			overrides: overrides,
+			bans:      bans,
 		}
-
-		allowMessage := false
-		if relay.DefaultMessagePolicy {
-			allowMessage = true
+		if err := serveAdmin(adminListen, viper.GetString("ADMIN_TOKEN"), admin); err != nil {
+			log(fmt.Sprintf("Warn: could not start admin API on %s: %v", adminListen, err))
 		}
-		badResp := ""
-
-		// moderation retroactive delete
-		if e.Event.Kind == 1984 || (e.Event.Kind == 7 && (e.Event.Content == "❌" || e.Event.Content == "🔨")) {
-
-			if isModAction(relay, e) {
-
-				thisReason := ""
-				thisEvent := ""
-				thisPubkey := ""
-				thisAction := ""
-
-				if e.Event.Kind == 1984 {
-					log(fmt.Sprintf("1984 request from %s>", e.Event.Pubkey))
-					for _, x := range e.Event.Tags {
-						if x[0] == "e" {
-							thisEvent = x[1]
-							thisReason = "mod action by " + e.Event.Pubkey + ": delete event"
-						}
-					}
-					for _, x := range e.Event.Tags {
-						if x[0] == "p" {
-							thisPubkey = x[1]
-							thisReason = "mod action by " + e.Event.Pubkey + ": block and delete pubkey"
-						}
-					}
-					if thisEvent != "" {
-						thisAction = "deleteEvent"
-					} else if thisPubkey != "" {
-						thisAction = "blockAndDeletePubkey"
-					}
-				} else if e.Event.Kind == 7 && e.Event.Content == "❌" {
-					// delete event
-					for _, x := range e.Event.Tags {
-						if x[0] == "e" {
-							thisEvent = x[1]
-							thisReason = "mod action by " + e.Event.Pubkey + ": delete event"
-						}
-					}
-					if thisEvent != "" {
-						thisAction = "deleteEvent"
-					}
-				} else if e.Event.Kind == 7 && e.Event.Content == "🔨" {
-					// delete the events related to this pubkey
-					for _, x := range e.Event.Tags {
-						if x[0] == "p" {
-							thisPubkey = x[1]
-							thisReason = "mod action by " + e.Event.Pubkey + ": block and delete pubkey"
-						}
-					}
-					if thisPubkey != "" {
-						thisAction = "blockAndDeletePubkey"
-					}
-				}
-
-				if thisAction == "deleteEvent" {
-					log(fmt.Sprintf("received action from mod: delete event <%s>, reason: %s", thisEvent, thisReason))
-					// shell out
-					filter := fmt.Sprintf("{\"ids\": [\"%s\"]}", thisEvent)
-					cmd := exec.Command("/app/strfry", "delete", "--filter", filter)
-					out, err := cmd.Output()
-					if err != nil {
-						log(fmt.Sprintln("could not run command: ", err))
-					}
-					log(fmt.Sprintln("strfry command output: ", string(out)))
-				} else if thisAction == "blockAndDeletePubkey" {
-					log(fmt.Sprintf("received action from mod: block and delete pubkey <%s>, reason: %s", thisPubkey, thisReason))
-					// shell ouma
-					filter := fmt.Sprintf("{\"authors\": [\"%s\"]}", thisPubkey)
-					cmd := exec.Command("/app/strfry", "delete", "--filter", filter)
-					out, err := cmd.Output()
-					if err != nil {
-						log(fmt.Sprintln("could not run command: ", err))
-					}
-					log(fmt.Sprintln("strfry command output: ", string(out)))
-				}
+	}
 
-				// don't publish mod actions, use shadowReject to silently drop them.
-				result.Action = "shadowReject"
-				r, _ := json.Marshal(result)
-				output.WriteString(fmt.Sprintf("%s\n", r))
-				output.Flush()
-				continue
-			}
-		}
+	if nip86Listen := viper.GetString("NIP86_LISTEN"); nip86Listen != "" {
+		serveNip86(nip86Listen, &nip86Server{
+			relay:     &currentRelay,
+			overrides: overrides,
+			bans:      bans,
+			lists:     managed,
+			url:       viper.GetString("NIP86_URL"),
+			upstream:  viper.GetBool("NIP86_PUSH_UPSTREAM"),
+		})
+	}
 
-		// pubkeys logic
-		// false is deny, true is allow
-		if !relay.DefaultMessagePolicy {
-			// relay is in whitelist pubkey mode, only allow these pubkeys to post
-			if value, ok := pubkeyMap.Load(e.Event.Pubkey); value != "" && ok {
-				// if use woa for tagged, only allow if it's from the relay ACL
-				if relay.UseWoaForTagged && value == "relay" {
-					log(fmt.Sprintf("WOATAGS:enabled allowing whitelist for %s from source:%s", e.Event.Pubkey, value))
-					allowMessage = true
-				} else if !relay.UseWoaForTagged {
-					log(fmt.Sprintf("WOATAGS:disabled allowing whitelist for %s from source:%s", e.Event.Pubkey, value))
-					allowMessage = true
-				}
-			}
+	// a reload reads the config files again, start watching once nothing
+	// else reads viper
+	watchReload()
 
-			// if we're allowing tags, check if pubkey is tagged in the messages ptags
-			if relay.AllowTagged {
-				if e.Event.Tags != nil && len(e.Event.Tags) >= 1 {
-					for _, x := range e.Event.Tags {
-
-						// if we are using woa for tagged, check if the tag is tagging someone in the relay ACL,
-						// then check that the pubkey tagging is in the whitelist
-						if x[0] == "p" && relay.UseWoaForTagged {
-							if value, ok := pubkeyMap.Load(x[1]); value == "relay" && ok {
-								if value, ok := pubkeyMap.Load(e.Event.Pubkey); value != "" && ok {
-									log(fmt.Sprintf("WOA: allowing whitelist for tagged pubkey: %s, %s ", x[1], value))
-									allowMessage = true
-								}
-							}
-						} else if x[0] == "p" {
-							if value, ok := pubkeyMap.Load(x[1]); value != "" && ok {
-								log(fmt.Sprintf("allowing whitelist for tagged pubkey: %s, %s ", x[1], value))
-								allowMessage = true
-							} else {
-								log(fmt.Sprintf("we didnt find a match for %s", x[1]))
-							}
-						}
+	for {
+		var input, _ = reader.ReadString('\n')
 
-					}
-				}
-			}
+		var e policy.StrfryEvent
+		if err := json.Unmarshal([]byte(input), &e); err != nil {
+			panic(err)
 		}
 
-		// allow keywords logic
-		if relay.AllowList.ListKeywords != nil && len(relay.AllowList.ListKeywords) >= 1 && !relay.DefaultMessagePolicy {
-			// relay has whitelist keywords, allow  messages matching any of these keywords to post, deny messages that don't.
-			// If they're allow_listed pubkey, we check the setting for allow_keyword_pubkey.
-			// If allow_keyword_pubkey is 'true' still want to obey the keyword list here and only allow the keywords.
-			// Else if allow_keyword_pubkey is 'false' we will allow the message if it matches the keyword list.
-			foundKeyword := false
-			for _, k := range relay.AllowList.ListKeywords {
-				dEvent := strings.ToLower(e.Event.Content)
-				dKeyword := strings.ToLower(k.Keyword)
-				if strings.Contains(dEvent, dKeyword) {
-					log("found keyword: " + k.Keyword)
-					foundKeyword = true
-				}
-			}
-			log(fmt.Sprintf("allow_keyword_pubkey: %t", relay.AllowKeywordPubkey))
+		relay := currentRelay.Load()
+		start := time.Now()
+		decision := pipeline.Decide(e, *relay, currentACL())
+		observeDecision(e, decision, time.Since(start))
 
-			if relay.AllowKeywordPubkey {
-				if foundKeyword && (allowMessage || isModAction(relay, e)) {
-					log("allow_keyword_pubkey=true, allowMessage=true, allowing for BOTH")
-					allowMessage = true
-				} else {
-					log("allow_keyword_pubkey=true, keyword AND pubkey not found, deny")
-					allowMessage = false
-				}
-			} else {
-				if foundKeyword {
-					log("allow_keyword_pubkey=false, pubkey allowed OR keyword allowed, allow")
-					allowMessage = true
-				}
-				// mod allowance check is required here, in keyword mode with allow_keyword_pubkey set to false
-				if isModAction(relay, e) {
-					log("allowing for mod: " + e.Event.Pubkey)
-					allowMessage = true
-				}
-			}
-			// The one specific case you wouldn't want to allow owner+mods is in this AllowList keywords mode
-			// Therefor, we will do the mod detector check here and allow all owners+mods for non keyword mode
-		} else {
-			// allow owners + moderators
-			if isModAction(relay, e) {
-				log("allowing for mod: " + e.Event.Pubkey)
-				allowMessage = true
-			}
+		if decision.ModAction != nil {
+			runModAction(*decision.ModAction, relay, upstreamModActions)
 		}
-
-		// if relay is in Deny mode, and message was being blocked by the ACLs above this, we need to check if the kind is in the allow list, and allow it
-		if !relay.DefaultMessagePolicy {
-			if relay.AllowList.ListKinds != nil && len(relay.AllowList.ListKinds) >= 1 {
-				if !allowMessage {
-					for _, k := range relay.AllowList.ListKinds {
-						if e.Event.Kind == k.Kind {
-							allowMessage = true
-						}
-					}
-				}
-			}
+		for _, a := range decision.Triggered {
+			runModAction(a, relay, upstreamModActions)
 		}
 
-		// blocklist for pubkeys overrides the ACLs above this
-		if relay.BlockList.ListPubkeys != nil && len(relay.BlockList.ListPubkeys) >= 1 {
-			// relay is in blacklist pubkey mode, mark bad
-			for _, k := range relay.BlockList.ListPubkeys {
-				if strings.Contains(k.Pubkey, "npub") {
-					if _, v, err := nip19.Decode(k.Pubkey); err == nil {
-						pub := v.(string)
-						if strings.Contains(e.Event.Pubkey, pub) {
-							log("rejecting for pubkey: " + k.Pubkey)
-							badResp = "blocked pubkey " + k.Pubkey + " reason: " + k.Reason
-							allowMessage = false
-						}
-					} else {
-						log("error decoding pubkey: " + k.Pubkey + " " + err.Error())
-					}
-				}
-				if strings.Contains(e.Event.Pubkey, k.Pubkey) {
-					log("rejecting for pubkey: " + k.Pubkey)
-					badResp = "blocked pubkey " + k.Pubkey + " reason: " + k.Reason
-					allowMessage = false
-				}
-			}
-		}
+		r, _ := json.Marshal(decision.Result(e.Event.ID))
+		output.WriteString(fmt.Sprintf("%s\n", r))
+		output.Flush()
 
-		// blocklist for keywords overrides the ACLs above this
-		if relay.BlockList.ListKeywords != nil && len(relay.BlockList.ListKeywords) >= 1 {
-			// relay has blacklist keywords, deny messages matching any of these keywords to post
-			for _, k := range relay.BlockList.ListKeywords {
-				dEvent := strings.ToLower(e.Event.Content)
-				dKeyword := strings.ToLower(k.Keyword)
-				if strings.Contains(dEvent, dKeyword) {
-					log("rejecting for keyword: " + k.Keyword)
-					badResp = "blocked. " + k.Keyword + " reason: " + k.Reason
-					allowMessage = false
-				}
-			}
+		if audit != nil {
+			audit.Write(newAuditRecord(e, decision, relay))
 		}
 
-		// not doing this anymore
-		// NIP59, NIP87, NIP86 (private groups/giftwrap allow)
-		//if relay.AllowGiftwrap {
-		//	if e.Event.Kind == 13 || e.Event.Kind == 1059 || e.Event.Kind == 1060 || e.Event.Kind == 24 || e.Event.Kind == 25 || e.Event.Kind == 26 || e.Event.Kind == 27 || e.Event.Kind == 35834 {
-		//		// allow all gifts
-		//		allowMessage = true
-		//		log("allowing for gift, kind: " + fmt.Sprintf("%d", e.Event.Kind))
-		//	}
-		//}
-
-		// Kind checking
-		// if a kind is blocked, it overrides all other ACLs above this
-		if relay.BlockList.ListKinds != nil && len(relay.BlockList.ListKinds) >= 1 {
-			for _, k := range relay.BlockList.ListKinds {
-				if e.Event.Kind == k.Kind {
-					badResp = "blocked kind " + fmt.Sprintf("%d", k.Kind) + " reason: " + k.Reason
-					allowMessage = false
-				}
+		// mod actions are not counted
+		if decision.Action != policy.ActionShadowReject {
+			settingsMu.RLock()
+			if active.influx != nil {
+				active.influx.write(e, decision, relay)
 			}
+			settingsMu.RUnlock()
 		}
+	}
+}
 
-		if !allowMessage {
-			result.Action = "reject"
-			result.Msg = badResp
-		}
-
-		r, _ := json.Marshal(result)
-		output.WriteString(fmt.Sprintf("%s\n", r))
-		output.Flush()
-
-		if influxEnabled {
-			blocked := 0
-			allowed := 1
-			if !allowMessage {
-				blocked = 1
-				allowed = 0
+// upstreamModActions records mod actions in the config API's block list
+var upstreamModActions bool
+
+// runModAction queues the strfry delete for a mod action, blocked pubkeys
+// are also banned. Bans, unbans and deletions are recorded in the history,
+// and upstream when push is set and the config comes from the API.
+func runModAction(a policy.ModAction, relay *policy.Relay, push bool) {
+	var method, list, listID string
+	unblock := false
+	var body interface{}
+	method = http.MethodPost
+	if a.Action == "deleteEvent" {
+		log(fmt.Sprintf("received action from mod: delete event <%s>, reason: %s", a.EventID, a.Reason))
+		deleter.DeleteEvent(a.EventID)
+		list, body = "blocklistevent", map[string]string{"event_id": a.EventID, "reason": a.Reason}
+	} else if a.Action == "hideEvent" {
+		log(fmt.Sprintf("hiding event <%s>, reason: %s", a.EventID, a.Reason))
+		if err := managed.BanEvent(a.EventID, a.Reason); err != nil {
+			log(fmt.Sprintf("error banning event %s: %s", a.EventID, err.Error()))
+		}
+		deleter.DeleteEvent(a.EventID)
+		list, body = "blocklistevent", map[string]string{"event_id": a.EventID, "reason": a.Reason}
+	} else if a.Action == "blockAndDeletePubkey" {
+		log(fmt.Sprintf("received action from mod: block and delete pubkey <%s>, reason: %s", a.Pubkey, a.Reason))
+		if _, err := bans.Add(Ban{Pubkey: a.Pubkey, Moderator: a.Moderator, Reason: a.Reason, ModEventID: a.ModEventID}); err != nil {
+			log(fmt.Sprintf("error banning %s: %s", a.Pubkey, err.Error()))
+			return
+		}
+		deleter.DeleteAuthor(a.Pubkey)
+		list, body = "blocklistpubkey", map[string]string{"pubkey": a.Pubkey, "reason": a.Reason}
+	} else if a.Action == "timeoutPubkey" {
+		until := time.Now().Add(time.Duration(a.DurationSeconds) * time.Second).UTC()
+		log(fmt.Sprintf("received action from mod: timeout pubkey <%s> until %s, reason: %s", a.Pubkey, until.Format(time.RFC3339), a.Reason))
+		stored, err := bans.Add(Ban{Pubkey: a.Pubkey, Moderator: a.Moderator, Reason: a.Reason, ModEventID: a.ModEventID, ExpiresAt: policy.Expiry{Time: until}})
+		if err != nil {
+			log(fmt.Sprintf("error timing out %s: %s", a.Pubkey, err.Error()))
+			return
+		}
+		if a.EventID != "" {
+			deleter.DeleteEvent(a.EventID)
+		}
+		if !stored {
+			// a longer ban stays, upstream included
+			log(fmt.Sprintf("%s is already banned for longer, not timing out", a.Pubkey))
+			return
+		}
+		list, body = "blocklistpubkey", map[string]interface{}{"pubkey": a.Pubkey, "reason": a.Reason, "expires_at": until}
+	} else if a.Action == "logReport" {
+		log(fmt.Sprintf("received report from mod: pubkey <%s> event <%s>, reason: %s", a.Pubkey, a.EventID, a.Reason))
+	} else if a.Action == "unbanPubkey" {
+		log(fmt.Sprintf("received action from mod: unban pubkey <%s>, reason: %s", a.Pubkey, a.Reason))
+		if _, err := bans.Remove(a.Pubkey); err != nil {
+			log(fmt.Sprintf("error unbanning %s: %s", a.Pubkey, err.Error()))
+		}
+		unblock = true
+		for _, p := range relayPubkeys(relay, false) {
+			if policy.DecodePub(p.Pubkey) == a.Pubkey && p.ID != "" {
+				listID = p.ID
 			}
-
-			p := influxdb2.NewPoint(
-				iConfig.Measurement,
-				map[string]string{
-					"kind":  fmt.Sprintf("%d", e.Event.Kind),
-					"relay": relay.ID,
-				},
-				map[string]interface{}{
-					"event":   1,
-					"blocked": blocked,
-					"allowed": allowed,
-				},
-				time.Now())
-			// write asynchronously
-			writeAPI.WritePoint(p)
 		}
+	} else {
+		return
+	}
+	modActionsTotal.WithLabelValues(a.Action).Inc()
+	history.Record(HistoryEntry{
+		Action:     a.Action,
+		Moderator:  a.Moderator,
+		Pubkey:     a.Pubkey,
+		EventID:    a.EventID,
+		ModEventID: a.ModEventID,
+		Reason:     a.Reason,
+	})
+	// community actions stay local, only moderators edit the API lists
+	if !push || a.Moderator == communityModerator || currentSettings().relayFile != "" {
+		return
+	}
+	if unblock {
+		// the ban may not be in the relay config yet, or not even sent
+		outbox.Unblock(relay.ID, a.Pubkey, listID)
+	} else if list != "" {
+		outbox.Add(relay.ID, method, list, listID, body)
 	}
 }
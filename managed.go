@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+)
+
+// ManagedEntry is one kind or event id on a managed list
+type ManagedEntry struct {
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ManagedLists are the allowed pubkey, kind and event id lists edited
+// through the NIP-86 management API. Banned pubkeys go to the overrides.
+// They apply on top of the relay's own lists and are saved to the state db.
+type ManagedLists struct {
+	mu           sync.RWMutex
+	AllowPubkeys map[string]ManagedEntry `json:"allow_pubkeys"`
+	AllowKinds   map[int]ManagedEntry    `json:"allow_kinds"`
+	BlockKinds   map[int]ManagedEntry    `json:"block_kinds"`
+	BannedEvents map[string]ManagedEntry `json:"banned_events"`
+	store        *Store
+}
+
+// managed holds the managed lists, set up in main
+var managed *ManagedLists
+
+func newManagedLists(s *Store) *ManagedLists {
+	l := &ManagedLists{store: s}
+	if s != nil {
+		if _, err := s.get(managedBucket, currentKey, l); err != nil {
+			log(fmt.Sprintf("error loading managed lists: %s", err.Error()))
+		}
+	}
+	if l.AllowPubkeys == nil {
+		l.AllowPubkeys = make(map[string]ManagedEntry)
+	}
+	if l.AllowKinds == nil {
+		l.AllowKinds = make(map[int]ManagedEntry)
+	}
+	if l.BlockKinds == nil {
+		l.BlockKinds = make(map[int]ManagedEntry)
+	}
+	if l.BannedEvents == nil {
+		l.BannedEvents = make(map[string]ManagedEntry)
+	}
+	return l
+}
+
+// update changes the lists under the lock and saves them
+func (l *ManagedLists) update(fn func()) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fn()
+	if l.store != nil {
+		return l.store.put(managedBucket, currentKey, l)
+	}
+	return nil
+}
+
+// AllowPubkey adds a hex pubkey to the allow list
+func (l *ManagedLists) AllowPubkey(pubkey string, reason string) error {
+	return l.update(func() {
+		l.AllowPubkeys[pubkey] = ManagedEntry{Reason: reason, CreatedAt: time.Now().UTC()}
+	})
+}
+
+// UnallowPubkey takes a pubkey off the allow list, reporting whether it was
+// on it
+func (l *ManagedLists) UnallowPubkey(pubkey string) (bool, error) {
+	found := false
+	err := l.update(func() {
+		_, found = l.AllowPubkeys[pubkey]
+		delete(l.AllowPubkeys, pubkey)
+	})
+	return found, err
+}
+
+// AllowKind allows kind, taking it off the block list
+func (l *ManagedLists) AllowKind(kind int, reason string) error {
+	return l.update(func() {
+		delete(l.BlockKinds, kind)
+		l.AllowKinds[kind] = ManagedEntry{Reason: reason, CreatedAt: time.Now().UTC()}
+	})
+}
+
+// BlockKind blocks kind, taking it off the allow list
+func (l *ManagedLists) BlockKind(kind int, reason string) error {
+	return l.update(func() {
+		delete(l.AllowKinds, kind)
+		l.BlockKinds[kind] = ManagedEntry{Reason: reason, CreatedAt: time.Now().UTC()}
+	})
+}
+
+func (l *ManagedLists) BanEvent(id string, reason string) error {
+	id = strings.ToLower(id)
+	return l.update(func() {
+		l.BannedEvents[id] = ManagedEntry{Reason: reason, CreatedAt: time.Now().UTC()}
+	})
+}
+
+func (l *ManagedLists) UnbanEvent(id string) error {
+	id = strings.ToLower(id)
+	return l.update(func() {
+		delete(l.BannedEvents, id)
+	})
+}
+
+func (l *ManagedLists) allowedPubkey(pubkey string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok := l.AllowPubkeys[pubkey]
+	return ok
+}
+
+func (l *ManagedLists) pubkeys() map[string]ManagedEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	pubkeys := make(map[string]ManagedEntry, len(l.AllowPubkeys))
+	for pubkey, e := range l.AllowPubkeys {
+		pubkeys[pubkey] = e
+	}
+	return pubkeys
+}
+
+func (l *ManagedLists) kind(kind int) (allowed bool, block ManagedEntry, blocked bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, allowed = l.AllowKinds[kind]
+	block, blocked = l.BlockKinds[kind]
+	return
+}
+
+func (l *ManagedLists) bannedEvent(id string) (ManagedEntry, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	e, ok := l.BannedEvents[id]
+	return e, ok
+}
+
+func (l *ManagedLists) kinds(allow bool) []int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	m := l.BlockKinds
+	if allow {
+		m = l.AllowKinds
+	}
+	kinds := make([]int, 0, len(m))
+	for k := range m {
+		kinds = append(kinds, k)
+	}
+	sort.Ints(kinds)
+	return kinds
+}
+
+func (l *ManagedLists) events() map[string]ManagedEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	events := make(map[string]ManagedEntry, len(l.BannedEvents))
+	for id, e := range l.BannedEvents {
+		events[id] = e
+	}
+	return events
+}
+
+// ManagedAllowPubkeyRule allows pubkeys from the managed allow list like
+// the relay's allow list pubkeys, when the relay is in whitelist mode
+type ManagedAllowPubkeyRule struct {
+	lists *ManagedLists
+}
+
+func NewManagedAllowPubkeyRule(l *ManagedLists) *ManagedAllowPubkeyRule {
+	return &ManagedAllowPubkeyRule{lists: l}
+}
+
+func (*ManagedAllowPubkeyRule) Name() string { return "managed_allow_pubkey" }
+
+func (r *ManagedAllowPubkeyRule) Evaluate(ev *policy.Evaluation) {
+	if ev.Relay.DefaultMessagePolicy {
+		return
+	}
+	if r.lists.allowedPubkey(ev.Event.Event.Pubkey) {
+		ev.Accept(r.Name())
+	}
+}
+
+// ManagedAllowKindRule allows kinds from the managed allow list when the
+// relay is in whitelist mode and nothing above allowed the event, next to
+// AllowKindRule so the block lists still apply
+type ManagedAllowKindRule struct {
+	lists *ManagedLists
+}
+
+func NewManagedAllowKindRule(l *ManagedLists) *ManagedAllowKindRule {
+	return &ManagedAllowKindRule{lists: l}
+}
+
+func (*ManagedAllowKindRule) Name() string { return "managed_allow_kind" }
+
+func (r *ManagedAllowKindRule) Evaluate(ev *policy.Evaluation) {
+	if ev.Relay.DefaultMessagePolicy || ev.Allow {
+		return
+	}
+	if allowed, _, _ := r.lists.kind(ev.Event.Event.Kind); allowed {
+		ev.Accept(r.Name())
+	}
+}
+
+// ManagedListRule applies the managed block lists after the relay block
+// lists: banned events and blocked kinds are rejected
+type ManagedListRule struct {
+	lists *ManagedLists
+}
+
+func NewManagedListRule(l *ManagedLists) *ManagedListRule {
+	return &ManagedListRule{lists: l}
+}
+
+func (*ManagedListRule) Name() string { return "managed_list" }
+
+func (r *ManagedListRule) Evaluate(ev *policy.Evaluation) {
+	e := ev.Event.Event
+	if _, block, blocked := r.lists.kind(e.Kind); blocked {
+		ev.Reject(r.Name(), fmt.Sprintf("blocked kind %d reason: %s", e.Kind, block.Reason))
+	}
+	if b, ok := r.lists.bannedEvent(e.ID); ok {
+		ev.Reject(r.Name(), "blocked: event is banned reason: "+b.Reason)
+	}
+}
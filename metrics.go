@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	decisionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spamblaster_decisions_total",
+		Help: "Write policy decisions by action, kind and rule.",
+	}, []string{"action", "kind", "rule"})
+
+	decisionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "spamblaster_decision_duration_seconds",
+		Help:    "Time taken to decide on one event.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+	})
+
+	aclFetchTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spamblaster_acl_fetch_total",
+		Help: "ACL source fetches by type and result.",
+	}, []string{"type", "result"})
+
+	aclFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "spamblaster_acl_fetch_duration_seconds",
+		Help:    "Time taken to fetch an ACL source.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 13),
+	}, []string{"type"})
+
+	modActionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spamblaster_mod_actions_total",
+		Help: "Moderator actions executed by action.",
+	}, []string{"action"})
+
+	// last successful relay config poll, unix nanoseconds
+	lastConfigPoll atomic.Int64
+)
+
+// aclSizeCollector reports the pubkeyMap size per source at scrape time,
+// counted the same way mapLen does
+type aclSizeCollector struct {
+	m    *sync.Map
+	desc *prometheus.Desc
+}
+
+func (c aclSizeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c aclSizeCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := make(map[string]int)
+	c.m.Range(func(k, v interface{}) bool {
+		s, _ := v.(string)
+		counts[s]++
+		return true
+	})
+	for source, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), source)
+	}
+}
+
+func newMetricsRegistry(m *sync.Map) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		decisionsTotal,
+		decisionDuration,
+		aclFetchTotal,
+		aclFetchDuration,
+		modActionsTotal,
+		aclSizeCollector{
+			m:    m,
+			desc: prometheus.NewDesc("spamblaster_acl_pubkeys", "Pubkeys in the ACL by source.", []string{"source"}, nil),
+		},
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "spamblaster_config_poll_age_seconds",
+			Help: "Seconds since the relay config was last fetched successfully.",
+		}, func() float64 {
+			last := lastConfigPoll.Load()
+			if last == 0 {
+				return -1
+			}
+			return time.Since(time.Unix(0, last)).Seconds()
+		}),
+	)
+	return reg
+}
+
+// serveMetrics exposes /metrics on addr, in the background
+func serveMetrics(addr string, m *sync.Map) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(newMetricsRegistry(m), promhttp.HandlerOpts{}))
+	go func() {
+		log(fmt.Sprintf("Info: serving metrics on %s/metrics", addr))
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log(fmt.Sprintf("metrics listener stopped: %s", err.Error()))
+		}
+	}()
+}
+
+// metricKinds get their own kind label, kind is chosen by clients so any
+// other kind is counted by range
+var metricKinds = map[int]bool{
+	0: true, 1: true, 3: true, 4: true, 5: true, 6: true, 7: true, 8: true,
+	9: true, 10: true, 11: true, 12: true, 13: true, 14: true, 16: true,
+	40: true, 41: true, 42: true, 43: true, 44: true, 1059: true, 1063: true,
+	1311: true, 1984: true, 1985: true, 9734: true, 9735: true, 9802: true,
+	10000: true, 10001: true, 10002: true, 13194: true, 22242: true,
+	23194: true, 23195: true, 24133: true, 27235: true, 30000: true,
+	30001: true, 30008: true, 30009: true, 30023: true, 30024: true,
+	30078: true, 30311: true, 31922: true, 31923: true, 34550: true,
+}
+
+// kindLabel keeps the kind label of the decision metrics bounded
+func kindLabel(kind int) string {
+	switch {
+	case metricKinds[kind]:
+		return fmt.Sprintf("%d", kind)
+	case kind >= 10000 && kind < 20000:
+		return "replaceable"
+	case kind >= 20000 && kind < 30000:
+		return "ephemeral"
+	case kind >= 30000 && kind < 40000:
+		return "addressable"
+	}
+	return "other"
+}
+
+func observeDecision(e policy.StrfryEvent, d policy.Decision, took time.Duration) {
+	decisionsTotal.WithLabelValues(d.Action, kindLabel(e.Event.Kind), d.Rule).Inc()
+	decisionDuration.Observe(took.Seconds())
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// nip86Server serves the NIP-86 relay management JSON-RPC API. Calls are
+// authenticated with NIP-98 and only the relay owner and moderators may
+// use it. Pubkey bans become overrides, allowed pubkeys, kinds and event
+// ids go to the managed lists.
+type nip86Server struct {
+	relay     *atomic.Pointer[policy.Relay]
+	overrides *Overrides
+	bans      *Bans
+	lists     *ManagedLists
+	url       string // expected NIP-98 u tag, from the request when empty
+	upstream  bool   // push pubkey and kind changes to the config API
+}
+
+type nip86Request struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+type nip86Response struct {
+	Result interface{} `json:"result"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type nip86Pubkey struct {
+	Pubkey string `json:"pubkey"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type nip86Event struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+var nip86Methods = []string{
+	"supportedmethods",
+	"banpubkey", "unbanpubkey", "listbannedpubkeys",
+	"allowpubkey", "unallowpubkey", "listallowedpubkeys",
+	"banevent", "allowevent", "listbannedevents",
+	"allowkind", "disallowkind", "listallowedkinds", "listdisallowedkinds",
+}
+
+// serveNip86 starts the management API on addr in the background
+func serveNip86(addr string, n *nip86Server) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           n,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	go func() {
+		log(fmt.Sprintf("Info: serving NIP-86 management API on %s", addr))
+		if err := srv.ListenAndServe(); err != nil {
+			log(fmt.Sprintf("NIP-86 listener stopped: %s", err.Error()))
+		}
+	}()
+}
+
+func (n *nip86Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// relay admin UIs call this from the browser
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+	if err != nil {
+		n.reply(w, http.StatusBadRequest, nil, err)
+		return
+	}
+	pubkey, err := n.authorize(r, body)
+	if err != nil {
+		log(fmt.Sprintf("NIP-86: unauthorized request: %s", err.Error()))
+		n.reply(w, http.StatusUnauthorized, nil, err)
+		return
+	}
+
+	var req nip86Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		n.reply(w, http.StatusBadRequest, nil, err)
+		return
+	}
+	result, err := n.call(pubkey, req)
+	if err != nil {
+		log(fmt.Sprintf("NIP-86: %s from %s failed: %s", req.Method, pubkey, err.Error()))
+	}
+	n.reply(w, http.StatusOK, result, err)
+}
+
+func (n *nip86Server) reply(w http.ResponseWriter, status int, result interface{}, err error) {
+	res := nip86Response{Result: result}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/nostr+json+rpc")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// authorize checks the NIP-98 Authorization header against the request and
+// returns the pubkey when it is the owner or a moderator
+func (n *nip86Server) authorize(r *http.Request, body []byte) (string, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !ok {
+		return "", errors.New("missing NIP-98 Authorization header")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+	if err != nil {
+		return "", errors.New("invalid NIP-98 token encoding")
+	}
+	var ev nostr.Event
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		return "", errors.New("invalid NIP-98 event")
+	}
+	if ev.Kind != 27235 {
+		return "", errors.New("NIP-98 event must be kind 27235")
+	}
+	if d := time.Since(ev.CreatedAt.Time()); d > time.Minute || d < -time.Minute {
+		return "", errors.New("NIP-98 event is too old or in the future")
+	}
+	if ok, err := ev.CheckSignature(); err != nil || !ok {
+		return "", errors.New("invalid NIP-98 signature")
+	}
+
+	u := ev.Tags.GetFirst([]string{"u", ""})
+	if u == nil || !n.matchURL(r, u.Value()) {
+		return "", errors.New("NIP-98 u tag does not match the request url")
+	}
+	method := ev.Tags.GetFirst([]string{"method", ""})
+	if method == nil || !strings.EqualFold(method.Value(), r.Method) {
+		return "", errors.New("NIP-98 method tag does not match the request")
+	}
+	payload := ev.Tags.GetFirst([]string{"payload", ""})
+	sum := sha256.Sum256(body)
+	if payload == nil || !strings.EqualFold(payload.Value(), hex.EncodeToString(sum[:])) {
+		return "", errors.New("NIP-98 payload tag does not match the request body")
+	}
+
+	relay := n.relay.Load()
+	if policy.DecodePub(relay.Owner.Pubkey) == ev.PubKey {
+		return ev.PubKey, nil
+	}
+	for _, m := range relay.Moderators {
+		if policy.DecodePub(m.User.Pubkey) == ev.PubKey {
+			return ev.PubKey, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not the owner or a moderator", ev.PubKey)
+}
+
+// matchURL compares the u tag with the configured url, or with the host and
+// path of the request when none is configured, since behind a proxy the
+// scheme is not known
+func (n *nip86Server) matchURL(r *http.Request, u string) bool {
+	if n.url != "" {
+		return strings.TrimSuffix(u, "/") == strings.TrimSuffix(n.url, "/")
+	}
+	_, rest, found := strings.Cut(u, "://")
+	if !found {
+		return false
+	}
+	return strings.TrimSuffix(rest, "/") == strings.TrimSuffix(r.Host+r.URL.Path, "/")
+}
+
+func paramString(params []interface{}, i int) string {
+	if i < len(params) {
+		s, _ := params[i].(string)
+		return s
+	}
+	return ""
+}
+
+func paramKind(params []interface{}) (int, error) {
+	if len(params) > 0 {
+		if f, ok := params[0].(float64); ok && validKind(int(f)) && f == float64(int(f)) {
+			return int(f), nil
+		}
+	}
+	return 0, errors.New("expected a kind number")
+}
+
+func paramPubkey(params []interface{}) (string, error) {
+	pubkey := policy.DecodePub(paramString(params, 0))
+	if !validPubkey(pubkey) {
+		return "", errors.New("expected a hex pubkey")
+	}
+	return pubkey, nil
+}
+
+func paramEventID(params []interface{}) (string, error) {
+	id := strings.ToLower(paramString(params, 0))
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 32 {
+		return "", errors.New("expected a hex event id")
+	}
+	return id, nil
+}
+
+// relayPubkeys returns the allow or block list pubkeys of the relay
+func relayPubkeys(relay *policy.Relay, allow bool) []policy.ListPubkey {
+	if allow {
+		return relay.AllowList.ListPubkeys
+	}
+	list := make([]policy.ListPubkey, 0, len(relay.BlockList.ListPubkeys))
+	for _, p := range relay.BlockList.ListPubkeys {
+		list = append(list, policy.ListPubkey{ID: p.ID, Pubkey: p.Pubkey, Reason: p.Reason, ExpiresAt: p.ExpiresAt})
+	}
+	return list
+}
+
+func (n *nip86Server) call(moderator string, req nip86Request) (interface{}, error) {
+	relay := n.relay.Load()
+	reason := paramString(req.Params, 1)
+	now := time.Now()
+
+	switch req.Method {
+	case "supportedmethods":
+		return nip86Methods, nil
+
+	case "banpubkey", "allowpubkey":
+		pubkey, err := paramPubkey(req.Params)
+		if err != nil {
+			return nil, err
+		}
+		list := "blocklistpubkey"
+		if req.Method == "allowpubkey" {
+			list = "allowlistpubkey"
+			err = n.lists.AllowPubkey(pubkey, reason)
+		} else {
+			err = n.overrides.Set(Override{Pubkey: pubkey, Action: OverrideBlock, Reason: reason})
+		}
+		if err != nil {
+			return nil, err
+		}
+		log(fmt.Sprintf("NIP-86: %s %s by %s, reason: %s", req.Method, pubkey, moderator, reason))
+		history.Record(HistoryEntry{Action: req.Method, Moderator: moderator, Pubkey: pubkey, Reason: reason})
+		n.push(relay, http.MethodPost, list, "", map[string]string{"pubkey": pubkey, "reason": reason})
+		return true, nil
+
+	case "unbanpubkey", "unallowpubkey":
+		pubkey, err := paramPubkey(req.Params)
+		if err != nil {
+			return nil, err
+		}
+		action, list := OverrideBlock, "blocklistpubkey"
+		if req.Method == "unallowpubkey" {
+			action, list = OverrideAllow, "allowlistpubkey"
+		}
+		if action == OverrideAllow {
+			if _, err := n.lists.UnallowPubkey(pubkey); err != nil {
+				return nil, err
+			}
+		} else {
+			if ov, ok := n.overrides.Get(pubkey); ok && ov.Action == OverrideBlock {
+				if _, err := n.overrides.Remove(pubkey); err != nil {
+					return nil, err
+				}
+			}
+			if _, err := n.bans.Remove(pubkey); err != nil {
+				return nil, err
+			}
+		}
+		log(fmt.Sprintf("NIP-86: %s %s by %s", req.Method, pubkey, moderator))
+		history.Record(HistoryEntry{Action: req.Method, Moderator: moderator, Pubkey: pubkey, Reason: reason})
+		listID := ""
+		for _, p := range relayPubkeys(relay, action == OverrideAllow) {
+			if policy.DecodePub(p.Pubkey) == pubkey && p.ID != "" {
+				listID = p.ID
+			}
+		}
+		if action == OverrideBlock {
+			// a ban pushed since the last config poll has no list id yet
+			if n.upstream && currentSettings().relayFile == "" {
+				outbox.Unblock(relay.ID, pubkey, listID)
+			}
+		} else if listID != "" {
+			n.push(relay, http.MethodDelete, list, listID, nil)
+		}
+		return true, nil
+
+	case "listbannedpubkeys", "listallowedpubkeys":
+		action := OverrideBlock
+		if req.Method == "listallowedpubkeys" {
+			action = OverrideAllow
+		}
+		seen := map[string]bool{}
+		list := []nip86Pubkey{}
+		if action == OverrideAllow {
+			for pubkey, e := range n.lists.pubkeys() {
+				seen[pubkey] = true
+				list = append(list, nip86Pubkey{Pubkey: pubkey, Reason: e.Reason})
+			}
+		} else {
+			for _, ov := range n.overrides.List() {
+				if ov.Action == OverrideBlock {
+					seen[ov.Pubkey] = true
+					list = append(list, nip86Pubkey{Pubkey: ov.Pubkey, Reason: ov.Reason})
+				}
+			}
+			for _, ban := range n.bans.List() {
+				if !seen[ban.Pubkey] {
+					seen[ban.Pubkey] = true
+					list = append(list, nip86Pubkey{Pubkey: ban.Pubkey, Reason: ban.Reason})
+				}
+			}
+		}
+		for _, p := range relayPubkeys(relay, action == OverrideAllow) {
+			pubkey := policy.DecodePub(p.Pubkey)
+			if !p.ExpiresAt.Expired(now) && !seen[pubkey] {
+				seen[pubkey] = true
+				list = append(list, nip86Pubkey{Pubkey: pubkey, Reason: p.Reason})
+			}
+		}
+		return list, nil
+
+	case "banevent":
+		id, err := paramEventID(req.Params)
+		if err != nil {
+			return nil, err
+		}
+		if err := n.lists.BanEvent(id, reason); err != nil {
+			return nil, err
+		}
+		log(fmt.Sprintf("NIP-86: banevent %s by %s, reason: %s", id, moderator, reason))
+		runModAction(policy.ModAction{Action: "deleteEvent", EventID: id, Moderator: moderator, Reason: reason}, relay, n.upstream)
+		return true, nil
+
+	case "allowevent":
+		id, err := paramEventID(req.Params)
+		if err != nil {
+			return nil, err
+		}
+		if err := n.lists.UnbanEvent(id); err != nil {
+			return nil, err
+		}
+		log(fmt.Sprintf("NIP-86: allowevent %s by %s", id, moderator))
+		history.Record(HistoryEntry{Action: req.Method, Moderator: moderator, EventID: id, Reason: reason})
+		return true, nil
+
+	case "listbannedevents":
+		list := []nip86Event{}
+		for id, e := range n.lists.events() {
+			list = append(list, nip86Event{ID: id, Reason: e.Reason})
+		}
+		return list, nil
+
+	case "allowkind", "disallowkind":
+		kind, err := paramKind(req.Params)
+		if err != nil {
+			return nil, err
+		}
+		list := "allowlistkind"
+		if req.Method == "allowkind" {
+			err = n.lists.AllowKind(kind, reason)
+		} else {
+			list = "blocklistkind"
+			err = n.lists.BlockKind(kind, reason)
+		}
+		if err != nil {
+			return nil, err
+		}
+		log(fmt.Sprintf("NIP-86: %s %d by %s", req.Method, kind, moderator))
+		history.Record(HistoryEntry{Action: fmt.Sprintf("%s %d", req.Method, kind), Moderator: moderator, Reason: reason})
+		n.push(relay, http.MethodPost, list, "", map[string]interface{}{"kind": kind, "reason": reason})
+		return true, nil
+
+	case "listallowedkinds", "listdisallowedkinds":
+		allow := req.Method == "listallowedkinds"
+		seen := map[int]bool{}
+		kinds := []int{}
+		for _, k := range n.lists.kinds(allow) {
+			seen[k] = true
+			kinds = append(kinds, k)
+		}
+		var relayKinds []int
+		if allow {
+			for _, k := range relay.AllowList.ListKinds {
+				relayKinds = append(relayKinds, k.Kind)
+			}
+		} else {
+			for _, k := range relay.BlockList.ListKinds {
+				relayKinds = append(relayKinds, k.Kind)
+			}
+		}
+		for _, k := range relayKinds {
+			if !seen[k] {
+				seen[k] = true
+				kinds = append(kinds, k)
+			}
+		}
+		return kinds, nil
+	}
+	return nil, fmt.Errorf("method %q is not supported", req.Method)
+}
+
+// push queues a list change for the config API when enabled. The change is
+// already active locally.
+func (n *nip86Server) push(relay *policy.Relay, method string, list string, listID string, body interface{}) {
+	if !n.upstream || currentSettings().relayFile != "" {
+		return
+	}
+	outbox.Add(relay.ID, method, list, listID, body)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	testOwnerKey = "0000000000000000000000000000000000000000000000000000000000000001"
+	testOtherKey = "0000000000000000000000000000000000000000000000000000000000000002"
+)
+
+func nip98Token(t *testing.T, sk string, created time.Time, tags nostr.Tags) string {
+	t.Helper()
+	ev := nostr.Event{Kind: 27235, CreatedAt: nostr.Timestamp(created.Unix()), Tags: tags}
+	if err := ev.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := json.Marshal(ev)
+	return "Nostr " + base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestNip86Authorize(t *testing.T) {
+	owner, _ := nostr.GetPublicKey(testOwnerKey)
+	var relay policy.Relay
+	relay.Owner.Pubkey = owner
+	n := &nip86Server{relay: &atomic.Pointer[policy.Relay]{}, url: "https://relay.example.com"}
+	n.relay.Store(&relay)
+
+	body := []byte(`{"method":"supportedmethods","params":[]}`)
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	good := func() nostr.Tags {
+		return nostr.Tags{{"u", "https://relay.example.com/"}, {"method", "POST"}, {"payload", payload}}
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"valid", nip98Token(t, testOwnerKey, now, good()), true},
+		{"missing header", "", false},
+		{"not base64", "Nostr !!!", false},
+		{"wrong u tag", nip98Token(t, testOwnerKey, now, nostr.Tags{{"u", "https://evil.example.com/"}, {"method", "POST"}, {"payload", payload}}), false},
+		{"no u tag", nip98Token(t, testOwnerKey, now, nostr.Tags{{"method", "POST"}, {"payload", payload}}), false},
+		{"wrong method", nip98Token(t, testOwnerKey, now, nostr.Tags{{"u", "https://relay.example.com/"}, {"method", "GET"}, {"payload", payload}}), false},
+		{"wrong payload", nip98Token(t, testOwnerKey, now, nostr.Tags{{"u", "https://relay.example.com/"}, {"method", "POST"}, {"payload", strings.Repeat("0", 64)}}), false},
+		{"no payload", nip98Token(t, testOwnerKey, now, nostr.Tags{{"u", "https://relay.example.com/"}, {"method", "POST"}}), false},
+		{"stale", nip98Token(t, testOwnerKey, now.Add(-2*time.Minute), good()), false},
+		{"future", nip98Token(t, testOwnerKey, now.Add(2*time.Minute), good()), false},
+		{"not a moderator", nip98Token(t, testOtherKey, now, good()), false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "https://relay.example.com/", strings.NewReader(string(body)))
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		pubkey, err := n.authorize(r, body)
+		if tt.ok && (err != nil || pubkey != owner) {
+			t.Errorf("%s: got %q, %v, want the owner", tt.name, pubkey, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: authorized %q, want an error", tt.name, pubkey)
+		}
+	}
+}
+
+func TestNip86AuthorizeSignature(t *testing.T) {
+	owner, _ := nostr.GetPublicKey(testOwnerKey)
+	var relay policy.Relay
+	relay.Owner.Pubkey = owner
+	n := &nip86Server{relay: &atomic.Pointer[policy.Relay]{}}
+	n.relay.Store(&relay)
+
+	body := []byte(`{}`)
+	sum := sha256.Sum256(body)
+	ev := nostr.Event{Kind: 27235, CreatedAt: nostr.Now(), Tags: nostr.Tags{
+		{"u", "http://relay.example.com/"}, {"method", "POST"}, {"payload", hex.EncodeToString(sum[:])},
+	}}
+	if err := ev.Sign(testOwnerKey); err != nil {
+		t.Fatal(err)
+	}
+	// tampering after signing breaks the signature
+	ev.Tags = append(ev.Tags, nostr.Tag{"x", "y"})
+	raw, _ := json.Marshal(ev)
+
+	r := httptest.NewRequest(http.MethodPost, "http://relay.example.com/", strings.NewReader(string(body)))
+	r.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(raw))
+	if _, err := n.authorize(r, body); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("got %v, want a signature error", err)
+	}
+}
+
+func TestNip86EventID(t *testing.T) {
+	_, relay := setupModActions(t)
+	n := &nip86Server{relay: &atomic.Pointer[policy.Relay]{}, lists: newManagedLists(nil)}
+	n.relay.Store(relay)
+
+	id := strings.Repeat("Ab", 32)
+	for _, method := range []string{"banevent", "allowevent"} {
+		for _, bad := range []interface{}{"", "xyz", strings.Repeat("ab", 31), strings.Repeat("zz", 32), 42} {
+			if _, err := n.call("mod", nip86Request{Method: method, Params: []interface{}{bad}}); err == nil {
+				t.Errorf("%s %v: want an error", method, bad)
+			}
+		}
+		if _, err := n.call("mod", nip86Request{Method: method, Params: []interface{}{id}}); err != nil {
+			t.Errorf("%s %s: %v", method, id, err)
+		}
+	}
+	if _, banned := n.lists.bannedEvent(strings.ToLower(id)); banned {
+		t.Error("event still banned after allowevent")
+	}
+}
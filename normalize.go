@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+)
+
+// keyword normalization and obfuscation filter settings from .spamblaster.env
+type normalizeConfig struct {
+	NormalizeKeywords bool `mapstructure:"NORMALIZE_KEYWORDS"`
+	ObfuscationFilter bool `mapstructure:"OBFUSCATION_FILTER"`
+	MaxCombining      int  `mapstructure:"OBFUSCATION_MAX_COMBINING"` // combining marks allowed on one character
+	MaxInvisible      int  `mapstructure:"OBFUSCATION_MAX_INVISIBLE"` // invisible characters allowed in content
+}
+
+func setNormalizeDefaults() {
+	viper.SetDefault("NORMALIZE_KEYWORDS", true)
+	viper.SetDefault("OBFUSCATION_FILTER", false)
+	viper.SetDefault("OBFUSCATION_MAX_COMBINING", 4)
+	viper.SetDefault("OBFUSCATION_MAX_INVISIBLE", 5)
+}
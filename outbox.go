@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+)
+
+// OutboxEntry is one list change waiting to be sent to the config API
+type OutboxEntry struct {
+	ID          uint64          `json:"id"`
+	RelayID     string          `json:"relay_id"`
+	Method      string          `json:"method"`
+	List        string          `json:"list"` // e.g. blocklistpubkey
+	ListID      string          `json:"list_id,omitempty"`
+	Pubkey      string          `json:"pubkey,omitempty"` // for a removal, looked up when sent without ListID
+	Body        json.RawMessage `json:"body,omitempty"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// Outbox sends list changes to the config API with the performLogin
+// session. Entries are saved to the state db and retried with backoff until
+// the API takes them, so changes made while it is down are not lost.
+type Outbox struct {
+	mu      sync.Mutex
+	entries map[uint64]OutboxEntry
+	seq     uint64
+	store   *Store
+	wake    chan struct{}
+}
+
+// outbox is the queue of changes for the config API, set up in main
+var outbox *Outbox
+
+const (
+	outboxMinBackoff = 30 * time.Second
+	outboxMaxBackoff = time.Hour
+)
+
+func newOutbox(s *Store) *Outbox {
+	o := &Outbox{entries: make(map[uint64]OutboxEntry), store: s, wake: make(chan struct{}, 1)}
+	if s == nil {
+		return o
+	}
+	err := s.each(outboxBucket, func(k, v []byte) error {
+		var e OutboxEntry
+		if err := json.Unmarshal(v, &e); err != nil {
+			log(fmt.Sprintf("error loading outbox entry: %s", err.Error()))
+			return nil
+		}
+		o.entries[e.ID] = e
+		o.seq = max(o.seq, e.ID)
+		return nil
+	})
+	if err != nil {
+		log(fmt.Sprintf("error loading outbox: %s", err.Error()))
+	}
+	if len(o.entries) > 0 {
+		log(fmt.Sprintf("loaded %d pending upstream changes", len(o.entries)))
+	}
+	return o
+}
+
+// seqKey is a sequence number as a key that sorts in order
+func seqKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+// Add queues a change of list on the relay. Without a relay id, e.g. in
+// standalone mode, there is nothing to send to.
+func (o *Outbox) Add(relayID string, method string, list string, listID string, body interface{}) {
+	if relayID == "" {
+		return
+	}
+	e := OutboxEntry{
+		RelayID: relayID,
+		Method:  method,
+		List:    list,
+		ListID:  listID,
+	}
+	if body != nil {
+		e.Body, _ = json.Marshal(body)
+	}
+	o.add(e)
+}
+
+func (o *Outbox) add(e OutboxEntry) {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	o.mu.Lock()
+	o.seq++
+	e.ID = o.seq
+	o.entries[e.ID] = e
+	o.mu.Unlock()
+	o.save(e)
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Unblock queues the removal of pubkey from the relay's upstream block list.
+// Bans of pubkey still waiting in the outbox are dropped. Without the list
+// id, because the ban was sent after the last config poll, the entry is
+// looked up when the removal is sent, after anything queued ahead of it.
+func (o *Outbox) Unblock(relayID string, pubkey string, listID string) {
+	if relayID == "" {
+		return
+	}
+	pubkey = policy.DecodePub(pubkey)
+	var dropped []uint64
+	o.mu.Lock()
+	for id, e := range o.entries {
+		if e.RelayID != relayID || e.Method != http.MethodPost || e.List != "blocklistpubkey" {
+			continue
+		}
+		var body struct {
+			Pubkey string `json:"pubkey"`
+		}
+		if json.Unmarshal(e.Body, &body) == nil && policy.DecodePub(body.Pubkey) == pubkey {
+			dropped = append(dropped, id)
+		}
+	}
+	o.mu.Unlock()
+	for _, id := range dropped {
+		log(fmt.Sprintf("upstream: dropping pending ban of %s on relay %s", pubkey, relayID))
+		o.remove(id)
+	}
+
+	// without the list id a ban may be on its way already, look for it when
+	// this is sent
+	o.add(OutboxEntry{RelayID: relayID, Method: http.MethodDelete, List: "blocklistpubkey", ListID: listID, Pubkey: pubkey})
+}
+
+func (o *Outbox) save(e OutboxEntry) {
+	if o.store == nil {
+		return
+	}
+	if err := o.store.put(outboxBucket, seqKey(e.ID), e); err != nil {
+		log(fmt.Sprintf("error saving outbox entry %d: %s", e.ID, err.Error()))
+	}
+}
+
+func (o *Outbox) remove(id uint64) {
+	o.mu.Lock()
+	delete(o.entries, id)
+	o.mu.Unlock()
+	if o.store != nil {
+		if err := o.store.delete(outboxBucket, seqKey(id)); err != nil {
+			log(fmt.Sprintf("error removing outbox entry %d: %s", id, err.Error()))
+		}
+	}
+}
+
+// Pending returns the entries not sent yet, oldest first
+func (o *Outbox) Pending() []OutboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	list := make([]OutboxEntry, 0, len(o.entries))
+	for _, e := range o.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// subject is what the entry changes on its list, e.g. the pubkey, empty
+// when only the list id is known
+func (e OutboxEntry) subject() string {
+	if e.Pubkey != "" {
+		return e.Pubkey
+	}
+	var body struct {
+		Pubkey  string          `json:"pubkey"`
+		EventID string          `json:"event_id"`
+		Kind    json.RawMessage `json:"kind"`
+	}
+	if json.Unmarshal(e.Body, &body) != nil {
+		return ""
+	}
+	switch {
+	case body.Pubkey != "":
+		return policy.DecodePub(body.Pubkey)
+	case body.EventID != "":
+		return body.EventID
+	}
+	return string(body.Kind)
+}
+
+// sendPending sends the entries that are due, oldest first. Changes of the
+// same subject are sent in order, a ban and the unban after it must not
+// arrive the other way around, so an entry waiting for a retry holds up the
+// later ones of its subject. One without a subject holds up the rest of its
+// list, and waits for anything held up on it.
+func (o *Outbox) sendPending() {
+	held := make(map[string]bool)     // list and subject with an entry waiting
+	waiting := make(map[string]bool)  // lists with any entry waiting
+	barriers := make(map[string]bool) // lists with an entry without a subject waiting
+	for _, e := range o.Pending() {
+		list := e.RelayID + "/" + e.List
+		subject := e.subject()
+		key := list + "/" + subject
+		wait := barriers[list] || held[key] || subject == "" && waiting[list]
+		if wait || e.NextAttempt.After(time.Now()) || !o.send(e) {
+			held[key] = true
+			waiting[list] = true
+			if subject == "" {
+				barriers[list] = true
+			}
+		}
+	}
+}
+
+// Start sends entries in the background, when woken by Add and every few
+// seconds for retries.
+func (o *Outbox) Start() {
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-o.wake:
+			case <-ticker.C:
+			}
+			if currentSettings().relayFile != "" {
+				// standalone mode, keep them for when the API is used again
+				continue
+			}
+			o.sendPending()
+		}
+	}()
+}
+
+// send reports false when the entry is to be retried
+func (o *Outbox) send(e OutboxEntry) bool {
+	s := currentSettings()
+	if e.ListID == "" && e.Pubkey != "" {
+		listID, err := blockListID(s, e.Pubkey)
+		if err != nil {
+			return o.retry(e, err)
+		}
+		if listID == "" {
+			log(fmt.Sprintf("upstream: %s is not on the block list of relay %s, nothing to remove", e.Pubkey, e.RelayID))
+			o.remove(e.ID)
+			return true
+		}
+		e.ListID = listID
+	}
+	status, err := o.do(s, e)
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		// the session expired, log in again and retry once
+		s.login()
+		status, err = o.do(s, e)
+	}
+
+	switch {
+	case err == nil && status < 300:
+		log(fmt.Sprintf("upstream: %s %s on relay %s done", e.Method, e.List, e.RelayID))
+		o.remove(e.ID)
+		return true
+	case err == nil && status >= 400 && status < 500 && status != http.StatusUnauthorized &&
+		status != http.StatusForbidden && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests:
+		// the API will not take it however often it is sent
+		log(fmt.Sprintf("upstream: %s %s on relay %s rejected with %d, dropping it", e.Method, e.List, e.RelayID, status))
+		o.remove(e.ID)
+		return true
+	default:
+		if err == nil {
+			err = fmt.Errorf("status %d", status)
+		}
+		return o.retry(e, err)
+	}
+}
+
+// retry schedules the entry again with backoff, it holds up the ones after
+// it with the same subject
+func (o *Outbox) retry(e OutboxEntry, err error) bool {
+	e.Attempts++
+	backoff := min(outboxMinBackoff<<min(e.Attempts-1, 10), outboxMaxBackoff)
+	e.NextAttempt = time.Now().Add(backoff).UTC()
+	log(fmt.Sprintf("upstream: %s %s on relay %s failed (attempt %d), retrying in %s: %s", e.Method, e.List, e.RelayID, e.Attempts, backoff, err.Error()))
+	o.mu.Lock()
+	if _, ok := o.entries[e.ID]; ok {
+		o.entries[e.ID] = e
+	}
+	o.mu.Unlock()
+	o.save(e)
+	return false
+}
+
+// blockListID looks up the block list entry of pubkey in the relay config
+// from the API, empty when it is not there
+func blockListID(s *settings, pubkey string) (string, error) {
+	relay, err := queryRelay(s.apiURL, policy.Relay{})
+	if err != nil {
+		return "", err
+	}
+	for _, p := range relay.BlockList.ListPubkeys {
+		if policy.DecodePub(p.Pubkey) == pubkey && p.ID != "" {
+			return p.ID, nil
+		}
+	}
+	return "", nil
+}
+
+func (o *Outbox) do(s *settings, e OutboxEntry) (int, error) {
+	baseURL, err := s.baseURL()
+	if err != nil {
+		return 0, err
+	}
+	target := fmt.Sprintf("%s/api/relay/%s/%s", baseURL, e.RelayID, e.List)
+	if e.ListID != "" {
+		target += "?list_id=" + e.ListID
+	}
+	var body io.Reader
+	if e.Body != nil {
+		body = bytes.NewReader(e.Body)
+	}
+	req, err := http.NewRequest(e.Method, target, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
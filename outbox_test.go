@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jeremyd/spamblaster/policy"
+)
+
+// fakeConfigAPI serves the relay config and its pubkey block list
+type fakeConfigAPI struct {
+	mu      sync.Mutex
+	blocked map[string]string // list id -> pubkey
+	seq     int
+	calls   []string
+	down    map[string]bool // pubkeys whose ban fails with 503
+}
+
+func (f *fakeConfigAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, r.Method+" "+r.URL.Path)
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/sconfig/relays/r1":
+		type entry struct {
+			ID     string `json:"id"`
+			Pubkey string `json:"pubkey"`
+		}
+		list := []entry{}
+		for id, pubkey := range f.blocked {
+			list = append(list, entry{ID: id, Pubkey: pubkey})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":                     "r1",
+			"default_message_policy": true,
+			"block_list":             map[string]interface{}{"list_pubkeys": list},
+		})
+	case r.Method == http.MethodPost && r.URL.Path == "/api/relay/r1/blocklistpubkey":
+		var body struct {
+			Pubkey string `json:"pubkey"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if f.down[body.Pubkey] {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		f.seq++
+		f.blocked[fmt.Sprintf("L%d", f.seq)] = body.Pubkey
+	case r.Method == http.MethodDelete && r.URL.Path == "/api/relay/r1/blocklistpubkey":
+		id := r.URL.Query().Get("list_id")
+		if _, ok := f.blocked[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.blocked, id)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeConfigAPI) blockedPubkeys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var list []string
+	for _, pubkey := range f.blocked {
+		list = append(list, pubkey)
+	}
+	return list
+}
+
+// setupModActions points the mod action globals at a fake config API
+func setupModActions(t *testing.T) (*fakeConfigAPI, *policy.Relay) {
+	t.Helper()
+	api := &fakeConfigAPI{blocked: make(map[string]string)}
+	srv := httptest.NewServer(api)
+
+	oldActive, oldDeleter, oldBans, oldHistory, oldOutbox := active, deleter, bans, history, outbox
+	active = &settings{apiURL: srv.URL + "/api/sconfig/relays/r1"}
+	deleter = newStrfryDeleter(strfryConfig{})
+	bans = newBans(nil)
+	history = newModHistory(nil)
+	outbox = newOutbox(nil)
+	t.Cleanup(func() {
+		srv.Close()
+		active, deleter, bans, history, outbox = oldActive, oldDeleter, oldBans, oldHistory, oldOutbox
+	})
+	return api, &policy.Relay{ID: "r1", DefaultMessagePolicy: true}
+}
+
+// flushOutbox sends everything pending, in order
+func flushOutbox(t *testing.T) {
+	t.Helper()
+	for _, e := range outbox.Pending() {
+		if !outbox.send(e) {
+			t.Fatalf("sending %s %s failed", e.Method, e.List)
+		}
+	}
+}
+
+var testBanned = strings.Repeat("ab", 32)
+
+func banTestPubkey(relay *policy.Relay) {
+	runModAction(policy.ModAction{Action: "blockAndDeletePubkey", Pubkey: testBanned, Moderator: "mod", Reason: "spam"}, relay, true)
+}
+
+func unbanTestPubkey(relay *policy.Relay) {
+	runModAction(policy.ModAction{Action: "unbanPubkey", Pubkey: testBanned, Moderator: "mod", Reason: "oops"}, relay, true)
+}
+
+func TestBanThenUnbanBeforeSend(t *testing.T) {
+	api, relay := setupModActions(t)
+	banTestPubkey(relay)
+	unbanTestPubkey(relay)
+
+	for _, e := range outbox.Pending() {
+		if e.Method == http.MethodPost {
+			t.Errorf("the pending ban should have been dropped, got %+v", e)
+		}
+	}
+	flushOutbox(t)
+
+	if got := api.blockedPubkeys(); len(got) != 0 {
+		t.Errorf("upstream block list = %v, want empty", got)
+	}
+	if _, ok := bans.Get(testBanned); ok {
+		t.Error("local ban was not lifted")
+	}
+	if n := len(outbox.Pending()); n != 0 {
+		t.Errorf("%d entries left in the outbox", n)
+	}
+}
+
+func TestBanThenUnbanBeforePoll(t *testing.T) {
+	api, relay := setupModActions(t)
+	banTestPubkey(relay)
+	flushOutbox(t)
+	if got := api.blockedPubkeys(); len(got) != 1 {
+		t.Fatalf("upstream block list = %v, want the ban", got)
+	}
+
+	// the relay snapshot has not been polled since, it has no list id
+	unbanTestPubkey(relay)
+	flushOutbox(t)
+
+	if got := api.blockedPubkeys(); len(got) != 0 {
+		t.Errorf("upstream block list = %v, want empty", got)
+	}
+}
+
+func TestUnbanWithListID(t *testing.T) {
+	api, relay := setupModActions(t)
+	banTestPubkey(relay)
+	flushOutbox(t)
+
+	// after a poll the relay snapshot knows the entry
+	polled, err := queryRelay(active.apiURL, policy.Relay{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unbanTestPubkey(&polled)
+	flushOutbox(t)
+
+	if got := api.blockedPubkeys(); len(got) != 0 {
+		t.Errorf("upstream block list = %v, want empty", got)
+	}
+	for _, c := range api.calls[len(api.calls)-1:] {
+		if !strings.HasPrefix(c, http.MethodDelete) {
+			t.Errorf("last call %s, want the delete", c)
+		}
+	}
+}
+
+func TestUnbanNeverBanned(t *testing.T) {
+	api, relay := setupModActions(t)
+	unbanTestPubkey(relay)
+	flushOutbox(t)
+	for _, c := range api.calls {
+		if strings.HasPrefix(c, http.MethodDelete) {
+			t.Errorf("unexpected %s for a pubkey that was never on the block list", c)
+		}
+	}
+}
+
+func TestTimeoutAfterBanKeepsBan(t *testing.T) {
+	api, relay := setupModActions(t)
+	banTestPubkey(relay)
+	flushOutbox(t)
+
+	runModAction(policy.ModAction{Action: "timeoutPubkey", Pubkey: testBanned, Moderator: "mod", Reason: "report", DurationSeconds: 60}, relay, true)
+	if n := len(outbox.Pending()); n != 0 {
+		t.Errorf("%d entries queued, the permanent ban should stay upstream", n)
+	}
+	if ban, ok := bans.Get(testBanned); !ok || !ban.ExpiresAt.IsZero() {
+		t.Errorf("local ban = %+v, want the permanent ban", ban)
+	}
+	if n := len(history.List(testBanned, 10)); n != 1 {
+		t.Errorf("%d history entries, want only the ban", n)
+	}
+	if got := api.blockedPubkeys(); len(got) != 1 {
+		t.Errorf("upstream block list = %v, want the ban", got)
+	}
+}
+
+func TestBanInvalidPubkey(t *testing.T) {
+	_, relay := setupModActions(t)
+	runModAction(policy.ModAction{Action: "blockAndDeletePubkey", Pubkey: "nope", Moderator: "mod", Reason: "spam"}, relay, true)
+	if n := len(outbox.Pending()); n != 0 {
+		t.Errorf("%d entries queued for an invalid pubkey", n)
+	}
+	if field, values := deleter.next(); field != "" {
+		t.Errorf("queued a strfry delete of %s %v", field, values)
+	}
+}
+
+func TestOutboxFailureHoldsOnlyItsSubject(t *testing.T) {
+	api, relay := setupModActions(t)
+	other := strings.Repeat("cd", 32)
+	api.down = map[string]bool{testBanned: true}
+	banTestPubkey(relay)
+	runModAction(policy.ModAction{Action: "blockAndDeletePubkey", Pubkey: other, Moderator: "mod", Reason: "spam"}, relay, true)
+	// only the list id is known, it waits for the failed ban
+	outbox.Add(relay.ID, http.MethodDelete, "blocklistpubkey", "L9", nil)
+
+	outbox.sendPending()
+	if got := api.blockedPubkeys(); len(got) != 1 || got[0] != other {
+		t.Errorf("upstream block list = %v, want only %s", got, other)
+	}
+	pending := outbox.Pending()
+	if len(pending) != 2 || pending[0].Attempts != 1 || pending[1].Attempts != 0 {
+		t.Fatalf("pending = %+v, want the failed ban and the removal behind it", pending)
+	}
+
+	// nothing is due until the retry
+	api.down = nil
+	outbox.sendPending()
+	if n := len(outbox.Pending()); n != 2 {
+		t.Errorf("%d entries pending before the retry, want 2", n)
+	}
+	flushOutbox(t)
+	if got := api.blockedPubkeys(); len(got) != 2 {
+		t.Errorf("upstream block list = %v, want both bans", got)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+)
+
+const (
+	OverrideBlock = "block"
+	OverrideAllow = "allow"
+)
+
+// Override is a temporary block or allow for one pubkey, set through the
+// admin API. It applies on the next event, without waiting for the API.
+type Override struct {
+	Pubkey    string        `json:"pubkey"`
+	Action    string        `json:"action"`
+	Reason    string        `json:"reason"`
+	CreatedAt time.Time     `json:"created_at"`
+	ExpiresAt policy.Expiry `json:"expires_at"`
+}
+
+// Overrides holds the overrides by hex pubkey. They are saved to the state
+// db when there is one.
+type Overrides struct {
+	mu    sync.RWMutex
+	m     map[string]Override
+	store *Store
+}
+
+// newOverrides loads the saved overrides that have not expired
+func newOverrides(s *Store) *Overrides {
+	o := &Overrides{m: make(map[string]Override), store: s}
+	if s == nil {
+		return o
+	}
+	now := time.Now()
+	err := s.each(overrideBucket, func(k, v []byte) error {
+		var ov Override
+		if err := json.Unmarshal(v, &ov); err != nil {
+			log(fmt.Sprintf("error loading override %s: %s", k, err.Error()))
+			return nil
+		}
+		if !ov.ExpiresAt.Expired(now) {
+			o.m[ov.Pubkey] = ov
+		}
+		return nil
+	})
+	if err != nil {
+		log(fmt.Sprintf("error loading overrides: %s", err.Error()))
+	}
+	if len(o.m) > 0 {
+		log(fmt.Sprintf("loaded %d overrides", len(o.m)))
+	}
+	return o
+}
+
+func (o *Overrides) Set(ov Override) error {
+	ov.Pubkey = policy.DecodePub(ov.Pubkey)
+	if ov.Action != OverrideBlock && ov.Action != OverrideAllow {
+		return fmt.Errorf("action must be %s or %s", OverrideBlock, OverrideAllow)
+	}
+	if !validPubkey(ov.Pubkey) {
+		return fmt.Errorf("%q is not a hex pubkey or npub", ov.Pubkey)
+	}
+	if ov.ExpiresAt.Expired(time.Now()) {
+		return fmt.Errorf("expires_at is in the past")
+	}
+	if ov.CreatedAt.IsZero() {
+		ov.CreatedAt = time.Now().UTC()
+	}
+	o.mu.Lock()
+	o.m[ov.Pubkey] = ov
+	o.mu.Unlock()
+	if o.store != nil {
+		return o.store.put(overrideBucket, []byte(ov.Pubkey), ov)
+	}
+	return nil
+}
+
+// Remove deletes the override for pubkey, reporting whether there was one
+func (o *Overrides) Remove(pubkey string) (bool, error) {
+	pubkey = policy.DecodePub(pubkey)
+	o.mu.Lock()
+	_, ok := o.m[pubkey]
+	delete(o.m, pubkey)
+	o.mu.Unlock()
+	if ok && o.store != nil {
+		return ok, o.store.delete(overrideBucket, []byte(pubkey))
+	}
+	return ok, nil
+}
+
+// Get returns the override for pubkey if it has not expired
+func (o *Overrides) Get(pubkey string) (Override, bool) {
+	o.mu.RLock()
+	ov, ok := o.m[pubkey]
+	o.mu.RUnlock()
+	if !ok || ov.ExpiresAt.Expired(time.Now()) {
+		return Override{}, false
+	}
+	return ov, true
+}
+
+// List returns the overrides that have not expired, oldest first
+func (o *Overrides) List() []Override {
+	now := time.Now()
+	o.mu.RLock()
+	list := make([]Override, 0, len(o.m))
+	for _, ov := range o.m {
+		if !ov.ExpiresAt.Expired(now) {
+			list = append(list, ov)
+		}
+	}
+	o.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// OverrideAllowRule applies allow overrides like allow list pubkeys, right
+// after them, so the block lists, moderator bans, rate limits, spam and pow
+// rules still apply
+type OverrideAllowRule struct {
+	overrides *Overrides
+}
+
+func NewOverrideAllowRule(o *Overrides) *OverrideAllowRule {
+	return &OverrideAllowRule{overrides: o}
+}
+
+func (*OverrideAllowRule) Name() string { return "override_allow" }
+
+func (r *OverrideAllowRule) Evaluate(ev *policy.Evaluation) {
+	if ov, ok := r.overrides.Get(ev.Event.Event.Pubkey); ok && ov.Action == OverrideAllow {
+		ev.Accept(r.Name())
+	}
+}
+
+// OverrideRule applies block overrides after the relay lists
+type OverrideRule struct {
+	overrides *Overrides
+}
+
+func NewOverrideRule(o *Overrides) *OverrideRule {
+	return &OverrideRule{overrides: o}
+}
+
+func (*OverrideRule) Name() string { return "override" }
+
+func (r *OverrideRule) Evaluate(ev *policy.Evaluation) {
+	ov, ok := r.overrides.Get(ev.Event.Event.Pubkey)
+	if !ok || ov.Action != OverrideBlock {
+		return
+	}
+	ev.Logf("rejecting for override: %s", ov.Pubkey)
+	ev.Reject(r.Name(), "blocked: "+ov.Reason)
+}
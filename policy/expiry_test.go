@@ -0,0 +1,75 @@
+package policy
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestExpiryUnmarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    time.Time
+		invalid bool
+	}{
+		{"null", `null`, time.Time{}, false},
+		{"empty string", `""`, time.Time{}, false},
+		{"seconds", `1700000000`, time.Unix(1700000000, 0), false},
+		{"milliseconds", `1700000000123`, time.UnixMilli(1700000000123), false},
+		{"rfc3339", `"2023-11-14T22:13:20Z"`, time.Unix(1700000000, 0), false},
+		{"rfc3339 with offset", `"2023-11-14T23:13:20+01:00"`, time.Unix(1700000000, 0), false},
+		{"bad string never expires", `"next tuesday"`, time.Time{}, true},
+		{"object never expires", `{"at": 1}`, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		var x Expiry
+		if err := json.Unmarshal([]byte(tt.in), &x); err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if !x.Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, x.Time, tt.want)
+		}
+		if (x.Err() != nil) != tt.invalid {
+			t.Errorf("%s: Err() = %v, want invalid %t", tt.name, x.Err(), tt.invalid)
+		}
+	}
+}
+
+func TestExpiryInEntry(t *testing.T) {
+	// a bad expires_at does not break loading the rest of the entry
+	var p ListPubkey
+	if err := json.Unmarshal([]byte(`{"pubkey": "abc", "expires_at": true}`), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Pubkey != "abc" || !p.ExpiresAt.IsZero() {
+		t.Errorf("got %+v", p)
+	}
+
+	past := Expiry{Time: time.Now().Add(-time.Minute)}
+	if !past.Expired(time.Now()) {
+		t.Error("past expiry should be expired")
+	}
+	if (Expiry{}).Expired(time.Now()) {
+		t.Error("zero expiry should never expire")
+	}
+}
+
+func TestExpiryRoundTrip(t *testing.T) {
+	in := Expiry{Time: time.Unix(1700000000, 0)}
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Expiry
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.Equal(in.Time) {
+		t.Errorf("round trip %s: got %v, want %v", b, out.Time, in.Time)
+	}
+	if b, _ := json.Marshal(Expiry{}); string(b) != "null" {
+		t.Errorf("zero expiry marshals to %s, want null", b)
+	}
+}
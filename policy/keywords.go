@@ -0,0 +1,126 @@
+package policy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// keyword match modes for list_keywords match_mode
+const (
+	MatchSubstring = "substring" // default, case insensitive substring
+	MatchWord      = "word"      // whole word, so "ass" does not match "class"
+	MatchPrefix    = "prefix"    // a word starting with the keyword
+	MatchRegex     = "regex"     // case insensitive regular expression
+)
+
+// not a letter, digit or underscore, or the start / end of the content
+const wordStart = `(?:^|[^\p{L}\p{N}_])`
+const wordEnd = `(?:$|[^\p{L}\p{N}_])`
+
+type keywordMatcher struct {
+	keyword string
+	mode    string
+	re      *regexp.Regexp
+}
+
+func keywordKey(keyword string, mode string, normalize bool) string {
+	return fmt.Sprintf("%s:%t:%s", mode, normalize, keyword)
+}
+
+// ValidKeyword reports why a list keyword and match mode cannot be used,
+// nil when they can
+func ValidKeyword(keyword string, mode string) error {
+	_, err := compileKeyword(keyword, mode, false)
+	return err
+}
+
+func compileKeyword(keyword string, mode string, normalize bool) (*keywordMatcher, error) {
+	// patterns are compiled as written and matched against the raw and the
+	// normalized content, plain keywords get the same normalization as the
+	// content
+	normalized := keyword
+	if normalize {
+		normalized = Skeleton(keyword)
+	}
+	m := &keywordMatcher{keyword: strings.ToLower(normalized), mode: mode}
+	var pattern string
+	switch mode {
+	case "", MatchSubstring:
+		m.mode = MatchSubstring
+		return m, nil
+	case MatchWord:
+		pattern = wordStart + regexp.QuoteMeta(normalized) + wordEnd
+	case MatchPrefix:
+		pattern = wordStart + regexp.QuoteMeta(normalized)
+	case MatchRegex:
+		pattern = keyword
+	default:
+		return nil, fmt.Errorf("unknown match mode %s", mode)
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, err
+	}
+	m.re = re
+	return m, nil
+}
+
+// match checks the keyword against the content. normalized is the content
+// normalized for matching, regex patterns also see the raw content so
+// accents and non-latin letters in a pattern can match.
+func (m *keywordMatcher) match(raw string, normalized string) bool {
+	if m.mode == MatchRegex {
+		return m.re.MatchString(raw) || m.re.MatchString(normalized)
+	}
+	if m.re != nil {
+		return m.re.MatchString(normalized)
+	}
+	return strings.Contains(strings.ToLower(normalized), m.keyword)
+}
+
+// compileKeywords precompiles the allow and block list keywords, with and
+// without normalization, and returns the ones that are invalid. Invalid
+// patterns never match.
+func (relay *Relay) compileKeywords() []error {
+	var errs []error
+	relay.keywords = make(map[string]*keywordMatcher)
+	add := func(keyword string, mode string) {
+		for _, normalize := range []bool{true, false} {
+			key := keywordKey(keyword, mode, normalize)
+			if _, ok := relay.keywords[key]; ok {
+				continue
+			}
+			m, err := compileKeyword(keyword, mode, normalize)
+			if err != nil && normalize {
+				errs = append(errs, fmt.Errorf("error compiling keyword %s (%s): %w", keyword, mode, err))
+			}
+			relay.keywords[key] = m
+		}
+	}
+	for _, k := range relay.AllowList.ListKeywords {
+		add(k.Keyword, k.MatchMode)
+	}
+	for _, k := range relay.BlockList.ListKeywords {
+		add(k.Keyword, k.MatchMode)
+	}
+	return errs
+}
+
+// matchKeyword matches the event content against a list keyword using the
+// relay's precompiled matcher, relays that were not prepared fall back to
+// compiling on the fly.
+func (ev *Evaluation) matchKeyword(keyword string, mode string) bool {
+	m, ok := ev.Relay.keywords[keywordKey(keyword, mode, ev.normalize)]
+	if !ok {
+		var err error
+		m, err = compileKeyword(keyword, mode, ev.normalize)
+		if err != nil {
+			ev.Logf("error compiling keyword %s (%s): %s", keyword, mode, err.Error())
+		}
+	}
+	if m == nil {
+		return false
+	}
+	return m.match(ev.Event.Event.Content, ev.MatchContent())
+}
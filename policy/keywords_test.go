@@ -0,0 +1,60 @@
+package policy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestKeywordMatch(t *testing.T) {
+	tests := []struct {
+		keyword, mode, content string
+		want                   bool
+	}{
+		{"spam", MatchSubstring, "this is SPAM", true},
+		{"ass", MatchWord, "a class act", false},
+		{"ass", MatchWord, "what an ass!", true},
+		{"crypto", MatchPrefix, "cryptocurrency giveaway", true},
+		{"crypto", MatchPrefix, "no bitcrypto here", false},
+		{`fr[e3]{2} money`, MatchRegex, "FREE money", true},
+		{`fr[e3]{2} money`, MatchRegex, "fre3 money", true},
+		// non-latin and accented patterns see the raw content
+		{"привет", MatchRegex, "привет мир", true},
+		{"café", MatchRegex, "le café", true},
+		{`^caf[eé]$`, MatchRegex, "café", true},
+		// latin patterns still catch lookalike letters
+		{"spam", MatchRegex, "ѕраm", true},
+		{"spam", MatchSubstring, "ѕраm", true},
+	}
+	for _, tt := range tests {
+		m, err := compileKeyword(tt.keyword, tt.mode, true)
+		if err != nil {
+			t.Fatalf("compileKeyword(%q, %q): %v", tt.keyword, tt.mode, err)
+		}
+		if got := m.match(tt.content, Skeleton(tt.content)); got != tt.want {
+			t.Errorf("%s %q on %q = %t, want %t", tt.mode, tt.keyword, tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestBlockKeywordRegexRaw(t *testing.T) {
+	var relay Relay
+	err := json.Unmarshal([]byte(`{"default_message_policy": true, "block_list": {"list_keywords": [
+		{"keyword": "привет", "match_mode": "regex", "reason": "cyrillic"},
+		{"keyword": "café", "match_mode": "regex", "reason": "accent"}]}}`), &relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := relay.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, content := range []string{"привет мир", "le café"} {
+		var e StrfryEvent
+		e.Event.Kind = 1
+		e.Event.Content = content
+		d := DefaultPolicy().Decide(e, relay, MapACL{})
+		if d.Action != ActionReject || d.Rule != "block_keyword" {
+			t.Errorf("%q: got %s by %s, want reject by block_keyword", content, d.Action, d.Rule)
+		}
+	}
+}
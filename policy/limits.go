@@ -0,0 +1,103 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// EventLimitsRule rejects events over the relay's structural limits
+type EventLimitsRule struct{}
+
+func (EventLimitsRule) Name() string { return "event_limits" }
+
+func (r EventLimitsRule) Evaluate(ev *Evaluation) {
+	if !ev.Allow {
+		return
+	}
+	e := ev.Event.Event
+	for _, l := range ev.Relay.EventLimits {
+		if !l.Matches(e.Kind) {
+			continue
+		}
+		if msg := checkEventLimits(ev.Event, l); msg != "" {
+			ev.Logf("rejecting event %s from %s: %s", e.ID, e.Pubkey, msg)
+			ev.Reject(r.Name(), "invalid: "+msg)
+		}
+		return
+	}
+}
+
+func checkEventLimits(e StrfryEvent, l EventLimits) string {
+	if l.MaxContentBytes > 0 && len(e.Event.Content) > l.MaxContentBytes {
+		return fmt.Sprintf("content is %d bytes, limit is %d", len(e.Event.Content), l.MaxContentBytes)
+	}
+	if l.MaxTags > 0 && len(e.Event.Tags) > l.MaxTags {
+		return fmt.Sprintf("%d tags, limit is %d", len(e.Event.Tags), l.MaxTags)
+	}
+	if l.MaxTagValueLength > 0 {
+		for _, x := range e.Event.Tags {
+			for _, v := range x {
+				if len(v) > l.MaxTagValueLength {
+					return fmt.Sprintf("tag value is %d bytes, limit is %d", len(v), l.MaxTagValueLength)
+				}
+			}
+		}
+	}
+	if l.MaxEventBytes > 0 {
+		b, _ := json.Marshal(e.Event)
+		if len(b) > l.MaxEventBytes {
+			return fmt.Sprintf("event is %d bytes, limit is %d", len(b), l.MaxEventBytes)
+		}
+	}
+	return ""
+}
+
+// a base64 run at least this long is treated as an embedded blob
+const binaryRunLength = 512
+
+// BinaryContentRule rejects kind 1 notes carrying base64 blobs or binary
+// data instead of text
+type BinaryContentRule struct{}
+
+func (BinaryContentRule) Name() string { return "binary_content" }
+
+func (r BinaryContentRule) Evaluate(ev *Evaluation) {
+	if !ev.Allow || !ev.Relay.BlockBinaryContent || ev.Event.Event.Kind != 1 {
+		return
+	}
+	if looksBinary(ev.Event.Event.Content) {
+		ev.Logf("rejecting binary content in %s from %s", ev.Event.Event.ID, ev.Event.Event.Pubkey)
+		ev.Reject(r.Name(), "invalid: binary data in content")
+	}
+}
+
+// looksBinary detects control characters and long base64 runs. A run has
+// to mix upper and lower case, so bech32 strings like lightning invoices
+// and nostr: links are not mistaken for blobs.
+func looksBinary(content string) bool {
+	if !utf8.ValidString(content) {
+		return true
+	}
+	run, upper, lower := 0, false, false
+	for _, c := range content {
+		if c < 0x20 && c != '\n' && c != '\r' && c != '\t' {
+			return true
+		}
+		switch {
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= '0' && c <= '9', c == '+', c == '/', c == '=', c == '-', c == '_':
+		default:
+			run, upper, lower = 0, false, false
+			continue
+		}
+		run++
+		if run >= binaryRunLength && upper && lower {
+			return true
+		}
+	}
+	return false
+}
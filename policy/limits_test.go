@@ -0,0 +1,94 @@
+package policy
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestEventLimitsRule(t *testing.T) {
+	relay := testRelay(t, `{"default_message_policy": true, "event_limits": [
+		{"kind_from": 1, "kind_to": 1, "max_content_bytes": 10, "max_tags": 2, "max_tag_value_length": 8},
+		{"kind_from": 0, "kind_to": 0, "max_event_bytes": 400},
+		{"kind_from": 0, "kind_to": 10, "max_content_bytes": 1}]}`)
+
+	tests := []struct {
+		name    string
+		kind    int
+		content string
+		tags    [][]string
+		want    string
+	}{
+		{"within limits", 1, "0123456789", [][]string{{"t", "nostr"}, {"t", "12345678"}}, ActionAccept},
+		{"content too long", 1, "0123456789a", nil, ActionReject},
+		{"content counted in bytes", 1, "ééééé日", nil, ActionReject},
+		{"too many tags", 1, "hi", [][]string{{"t", "a"}, {"t", "b"}, {"t", "c"}}, ActionReject},
+		{"tag value too long", 1, "hi", [][]string{{"t", "123456789"}}, ActionReject},
+		{"tag name counts too", 1, "hi", [][]string{{"123456789"}}, ActionReject},
+		{"event fits", 0, strings.Repeat("x", 100), nil, ActionAccept},
+		{"event too big", 0, strings.Repeat("x", 400), nil, ActionReject},
+		{"event too big from tags", 0, "", [][]string{{"p", strings.Repeat("a", 400)}}, ActionReject},
+		// only the first matching entry applies, kind 0 and 1 have their own
+		{"later entry", 7, "+-", nil, ActionReject},
+		{"no entry", 30023, strings.Repeat("x", 1000), nil, ActionAccept},
+	}
+	for _, tt := range tests {
+		e := testEvent(alicePub, tt.kind, tt.content, tt.tags...)
+		d := NewPolicy(EventLimitsRule{}).Decide(e, relay, MapACL{})
+		if d.Action != tt.want {
+			t.Errorf("%s: %s (%s), want %s", tt.name, d.Action, d.Msg, tt.want)
+		}
+		if d.Action == ActionReject && !strings.HasPrefix(d.Msg, "invalid: ") {
+			t.Errorf("%s: message %q, want an invalid: prefix", tt.name, d.Msg)
+		}
+	}
+}
+
+func TestLooksBinary(t *testing.T) {
+	blob := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("\x00\x01binary\xfe\xff", 64)))
+	tests := []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{"text", "gm nostr, have a nice day", false},
+		{"newlines and tabs", "line one\n\tline two\r\n", false},
+		{"emoji", "🌅☕️ gm 👋🏽", false},
+		{"control character", "hello\x07world", true},
+		{"invalid utf-8", "hello\xffworld", true},
+		{"base64 blob", "look: " + blob, true},
+		{"short base64", blob[:binaryRunLength-1], false},
+		{"base64 split by spaces", blob[:300] + " " + blob[300:600], false},
+		{"lowercase bech32", "lnbc" + strings.Repeat("qpzry9x8gf2tvdw0s3jn54khce6mua7l", 20), false},
+		{"nostr link", "nostr:nevent1" + strings.Repeat("qpzry9x8gf2tvdw0s3jn54khce6mua7l", 20), false},
+		{"uppercase hex", strings.Repeat("DEADBEEF0123", 60), false},
+	}
+	for _, tt := range tests {
+		if got := looksBinary(tt.content); got != tt.want {
+			t.Errorf("%s: looksBinary = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBinaryContentRule(t *testing.T) {
+	blob := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("\x00\x01binary\xfe\xff", 64)))
+	on := testRelay(t, `{"default_message_policy": true, "block_binary_content": true}`)
+	off := testRelay(t, `{"default_message_policy": true}`)
+
+	tests := []struct {
+		name  string
+		relay Relay
+		kind  int
+		want  string
+	}{
+		{"kind 1", on, 1, ActionReject},
+		{"other kinds", on, 30023, ActionAccept},
+		{"turned off", off, 1, ActionAccept},
+	}
+	for _, tt := range tests {
+		d := NewPolicy(BinaryContentRule{}).Decide(testEvent(alicePub, tt.kind, blob), tt.relay, MapACL{})
+		if d.Action != tt.want {
+			t.Errorf("%s: %s (%s), want %s", tt.name, d.Action, d.Msg, tt.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package policy
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// latin lookalikes from other scripts, after NFKC has already folded
+// fullwidth and mathematical letters
+var confusables = map[rune]rune{
+	// cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p',
+	'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'ѕ': 's', 'і': 'i', 'ї': 'i', 'ј': 'j',
+	'ԁ': 'd', 'һ': 'h', 'ӏ': 'l', 'ԛ': 'q', 'ԝ': 'w', 'ɡ': 'g', 'ү': 'y', 'ѵ': 'v',
+	'А': 'A', 'В': 'B', 'Е': 'E', 'К': 'K', 'М': 'M', 'Н': 'H', 'О': 'O', 'Р': 'P',
+	'С': 'C', 'Т': 'T', 'У': 'Y', 'Х': 'X', 'Ѕ': 'S', 'І': 'I', 'Ј': 'J', 'Ү': 'Y',
+	'Ԁ': 'D', 'Ԛ': 'Q', 'Ԝ': 'W', 'Ӏ': 'I',
+	// greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x', 'ω': 'w',
+	'Α': 'A', 'Β': 'B', 'Ε': 'E', 'Ζ': 'Z', 'Η': 'H', 'Ι': 'I', 'Κ': 'K', 'Μ': 'M',
+	'Ν': 'N', 'Ο': 'O', 'Ρ': 'P', 'Τ': 'T', 'Υ': 'Y', 'Χ': 'X',
+	// latin extensions and symbols
+	'ı': 'i', 'ȷ': 'j', 'ʀ': 'r', 'ѡ': 'w', 'ꮪ': 's', 'ꓲ': 'I', 'ꓳ': 'O',
+}
+
+// isInvisible is true for zero width and other format characters that do
+// not render, like zero width space / joiner, word joiner and soft hyphen
+func isInvisible(r rune) bool {
+	return unicode.Is(unicode.Cf, r)
+}
+
+// isEmojiFormat is true for format characters used inside emoji: zero
+// width joiners that do not follow a letter and flag tag characters
+func isEmojiFormat(r rune, prev rune) bool {
+	if r == '\u200d' {
+		return !unicode.IsLetter(prev)
+	}
+	return r >= 0xE0020 && r <= 0xE007F
+}
+
+// isVariationSelector is true for the selectors used by emoji, which are
+// combining marks but not obfuscation
+func isVariationSelector(r rune) bool {
+	return (r >= 0xFE00 && r <= 0xFE0F) || (r >= 0xE0100 && r <= 0xE01EF)
+}
+
+// Skeleton normalizes text for keyword matching: NFKC folds fullwidth and
+// styled letters, invisible characters and combining marks (accents and
+// zalgo) are dropped and lookalike letters are mapped to latin. Case is
+// kept, keyword matching is case insensitive.
+func Skeleton(s string) string {
+	s = norm.NFKC.String(s)
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range norm.NFD.String(s) {
+		if isInvisible(r) || unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		b.WriteRune(r)
+	}
+	return norm.NFC.String(b.String())
+}
+
+// ObfuscationRule rejects content stacked with combining marks (zalgo) or
+// padded with invisible characters
+type ObfuscationRule struct {
+	MaxCombining int // combining marks allowed on one character
+	MaxInvisible int // invisible characters allowed in content
+}
+
+func (*ObfuscationRule) Name() string { return "obfuscation" }
+
+func (r *ObfuscationRule) Evaluate(ev *Evaluation) {
+	if !ev.Allow {
+		return
+	}
+	combining := 0
+	invisible := 0
+	var prev rune
+	for _, c := range ev.Event.Event.Content {
+		if unicode.Is(unicode.Mn, c) && !isVariationSelector(c) {
+			combining++
+			if combining > r.MaxCombining {
+				ev.Logf("rejecting for combining marks from %s", ev.Event.Event.Pubkey)
+				ev.Reject(r.Name(), "blocked: too many combining marks")
+				return
+			}
+			continue
+		}
+		combining = 0
+		// zero width joiners are part of emoji sequences, only count
+		// them between letters
+		if isInvisible(c) && !isEmojiFormat(c, prev) {
+			invisible++
+		}
+		prev = c
+	}
+	if invisible > r.MaxInvisible {
+		ev.Logf("rejecting for %d invisible characters from %s", invisible, ev.Event.Event.Pubkey)
+		ev.Reject(r.Name(), "blocked: too many invisible characters")
+	}
+}
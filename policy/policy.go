@@ -0,0 +1,252 @@
+// Package policy is the spamblaster write policy engine. A Policy runs a
+// strfry event through an ordered list of Rules against a snapshot of the
+// relay.tools relay config and an ACL, and returns the Decision strfry
+// expects. It has no global state, so other tools can embed it to check
+// events or to replay them against a config.
+package policy
+
+import (
+	"fmt"
+)
+
+// Strfry write policy actions
+const (
+	ActionAccept       = "accept"
+	ActionReject       = "reject"
+	ActionShadowReject = "shadowReject"
+)
+
+// Decision is the outcome of running an event through a Policy
+type Decision struct {
+	Action    string     // accept, reject or shadowReject
+	Msg       string     // sent to client for reject
+	Rule      string     // name of the rule that decided the outcome
+	ModAction *ModAction // set when the event is a moderator command
+
+	// Triggered are actions an accepted or rejected event set off, such as
+	// community report thresholds. They run like mod actions.
+	Triggered []ModAction
+}
+
+// Result converts the decision into the response strfry expects on stdout
+func (d Decision) Result(id string) StrfryResult {
+	return StrfryResult{
+		ID:     id,
+		Action: d.Action,
+		Msg:    d.Msg,
+	}
+}
+
+// ModAction is a moderation command issued by the relay owner or a moderator
+type ModAction struct {
+	Action     string `json:"action"` // deleteEvent, hideEvent, blockAndDeletePubkey, timeoutPubkey, unbanPubkey or logReport
+	EventID    string `json:"event_id,omitempty"`
+	Pubkey     string `json:"pubkey,omitempty"`
+	Moderator  string `json:"moderator"`
+	Reason     string `json:"reason"`
+	ModEventID string `json:"mod_event_id,omitempty"` // the report or reaction
+
+	DurationSeconds int `json:"duration_seconds,omitempty"` // for timeoutPubkey
+}
+
+// ACL is a read-only view of the pubkey access list, mapping pubkey to the
+// source it was loaded from ("relay" or an acl source ID)
+type ACL interface {
+	Source(pubkey string) (string, bool)
+}
+
+// MapACL is a plain map ACL, handy for tooling and tests
+type MapACL map[string]string
+
+func (a MapACL) Source(pubkey string) (string, bool) {
+	s, ok := a[pubkey]
+	return s, ok && s != ""
+}
+
+// Evaluation carries the state of a single event through the policy rules.
+// Rules read the event, relay and ACL and flip Allow, the same way the
+// original inline allowMessage / badResp logic did.
+type Evaluation struct {
+	Event StrfryEvent
+	Relay *Relay
+	ACL   ACL
+
+	Allow bool
+	Msg   string
+	Rule  string
+
+	// DryRun asks stateful rules (spam history, rate limit buckets) to
+	// decide without recording the event
+	DryRun bool
+
+	// Done stops evaluation, the current Decision is returned as is
+	Done      bool
+	decision  Decision
+	triggered []ModAction
+
+	matchContent *string
+	normalize    bool
+	log          func(string)
+}
+
+// MatchContent is the event content normalized for keyword matching,
+// computed once per event
+func (ev *Evaluation) MatchContent() string {
+	if ev.matchContent == nil {
+		c := ev.Event.Event.Content
+		if ev.normalize {
+			c = Skeleton(c)
+		}
+		ev.matchContent = &c
+	}
+	return *ev.matchContent
+}
+
+// Logf writes to the policy's Log, if it has one
+func (ev *Evaluation) Logf(format string, a ...interface{}) {
+	if ev.log != nil {
+		ev.log(fmt.Sprintf(format, a...))
+	}
+}
+
+// Accept marks the event as allowed by rule
+func (ev *Evaluation) Accept(rule string) {
+	ev.Allow = true
+	ev.Rule = rule
+}
+
+// Reject marks the event as denied by rule with a message for the client
+func (ev *Evaluation) Reject(rule string, msg string) {
+	ev.Allow = false
+	ev.Rule = rule
+	ev.Msg = msg
+}
+
+// Deny marks the event as denied by rule, keeping any message already set
+func (ev *Evaluation) Deny(rule string) {
+	ev.Allow = false
+	ev.Rule = rule
+}
+
+// Trigger adds an action to run whatever the decision
+func (ev *Evaluation) Trigger(a ModAction) {
+	ev.triggered = append(ev.triggered, a)
+}
+
+// Finish ends evaluation with the given decision
+func (ev *Evaluation) Finish(d Decision) {
+	ev.decision = d
+	ev.Done = true
+}
+
+// Rule is a single step of the policy pipeline
+type Rule interface {
+	Name() string
+	Evaluate(ev *Evaluation)
+}
+
+// Policy runs events through an ordered list of rules
+type Policy struct {
+	Rules []Rule
+
+	// Log receives what the rules have to say about an event, nil is
+	// quiet
+	Log func(string)
+	// Normalize matches keywords against the skeleton of the content and
+	// keyword, see Skeleton
+	Normalize bool
+}
+
+// NewPolicy returns a policy running rules in order, with keyword
+// normalization on
+func NewPolicy(rules ...Rule) *Policy {
+	return &Policy{Rules: rules, Normalize: true}
+}
+
+// Append adds rules to the end of the pipeline
+func (p *Policy) Append(rules ...Rule) {
+	p.Rules = append(p.Rules, rules...)
+}
+
+// Replace swaps the rule called name for rule
+func (p *Policy) Replace(name string, rule Rule) {
+	for i, r := range p.Rules {
+		if r.Name() == name {
+			p.Rules[i] = rule
+			return
+		}
+	}
+}
+
+// InsertAfter adds rules right after the rule called name, or at the end
+// when there is none
+func (p *Policy) InsertAfter(name string, rules ...Rule) {
+	for i, r := range p.Rules {
+		if r.Name() == name {
+			p.Rules = append(p.Rules[:i+1], append(rules, p.Rules[i+1:]...)...)
+			return
+		}
+	}
+	p.Append(rules...)
+}
+
+// DefaultPolicy reproduces the relay.tools relay modes: mod actions, pubkey
+// and keyword allow lists, kind and tag allow lists and the block lists that
+// override them, then the relay's created_at, size and binary content
+// limits. ObfuscationRule is not included, it has to be configured.
+func DefaultPolicy() *Policy {
+	return NewPolicy(
+		ModActionRule{},
+		AllowPubkeyRule{},
+		AllowTaggedRule{},
+		AllowKeywordRule{},
+		ModeratorRule{},
+		AllowKindRule{},
+		AllowTagRule{},
+		BlockPubkeyRule{},
+		BlockKeywordRule{},
+		BlockTagRule{},
+		BlockKindRule{},
+		CreatedAtRule{},
+		EventLimitsRule{},
+		BinaryContentRule{},
+	)
+}
+
+// Decide evaluates the event against a snapshot of the relay and ACL. The
+// relay is expected to have been through Prepare.
+func (p *Policy) Decide(e StrfryEvent, relay Relay, acl ACL) Decision {
+	return p.decide(e, relay, acl, false)
+}
+
+// DecideDryRun evaluates a hypothetical event, rule state is not changed
+func (p *Policy) DecideDryRun(e StrfryEvent, relay Relay, acl ACL) Decision {
+	return p.decide(e, relay, acl, true)
+}
+
+func (p *Policy) decide(e StrfryEvent, relay Relay, acl ACL, dryRun bool) Decision {
+	ev := &Evaluation{
+		Event:  e,
+		Relay:  &relay,
+		ACL:    acl,
+		Allow:  relay.DefaultMessagePolicy,
+		Rule:   "default_policy",
+		DryRun: dryRun,
+
+		normalize: p.Normalize,
+		log:       p.Log,
+	}
+
+	for _, r := range p.Rules {
+		r.Evaluate(ev)
+		if ev.Done {
+			ev.decision.Triggered = ev.triggered
+			return ev.decision
+		}
+	}
+
+	if !ev.Allow {
+		return Decision{Action: ActionReject, Msg: ev.Msg, Rule: ev.Rule, Triggered: ev.triggered}
+	}
+	return Decision{Action: ActionAccept, Rule: ev.Rule, Triggered: ev.triggered}
+}
@@ -0,0 +1,423 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+var (
+	ownerPub = strings.Repeat("01", 32)
+	modPub   = strings.Repeat("02", 32)
+	alicePub = strings.Repeat("0a", 32) // in the relay allow list
+	bobPub   = strings.Repeat("0b", 32) // from an acl source
+	evePub   = strings.Repeat("0e", 32) // unknown
+)
+
+var testACL = MapACL{
+	ownerPub: "relay",
+	modPub:   "relay",
+	alicePub: "relay",
+	bobPub:   "grapevine",
+}
+
+// legacyDecide is the inline decision loop spamblaster ran before the
+// policy engine, without the logging and the strfry deletes. It is the
+// reference the default policy has to match.
+func legacyDecide(e StrfryEvent, relay Relay, acl MapACL) Decision {
+	load := func(pubkey string) (string, bool) {
+		v, ok := acl[pubkey]
+		return v, ok
+	}
+
+	allowMessage := false
+	if relay.DefaultMessagePolicy {
+		allowMessage = true
+	}
+	badResp := ""
+
+	// moderation retroactive delete
+	if e.Event.Kind == 1984 || (e.Event.Kind == 7 && (e.Event.Content == "❌" || e.Event.Content == "🔨")) {
+		if IsModAction(relay, e) {
+			thisReason := ""
+			thisEvent := ""
+			thisPubkey := ""
+			thisAction := ""
+
+			if e.Event.Kind == 1984 {
+				for _, x := range e.Event.Tags {
+					if x[0] == "e" {
+						thisEvent = x[1]
+						thisReason = "mod action by " + e.Event.Pubkey + ": delete event"
+					}
+				}
+				for _, x := range e.Event.Tags {
+					if x[0] == "p" {
+						thisPubkey = x[1]
+						thisReason = "mod action by " + e.Event.Pubkey + ": block and delete pubkey"
+					}
+				}
+				if thisEvent != "" {
+					thisAction = "deleteEvent"
+				} else if thisPubkey != "" {
+					thisAction = "blockAndDeletePubkey"
+				}
+			} else if e.Event.Kind == 7 && e.Event.Content == "❌" {
+				for _, x := range e.Event.Tags {
+					if x[0] == "e" {
+						thisEvent = x[1]
+						thisReason = "mod action by " + e.Event.Pubkey + ": delete event"
+					}
+				}
+				if thisEvent != "" {
+					thisAction = "deleteEvent"
+				}
+			} else if e.Event.Kind == 7 && e.Event.Content == "🔨" {
+				for _, x := range e.Event.Tags {
+					if x[0] == "p" {
+						thisPubkey = x[1]
+						thisReason = "mod action by " + e.Event.Pubkey + ": block and delete pubkey"
+					}
+				}
+				if thisPubkey != "" {
+					thisAction = "blockAndDeletePubkey"
+				}
+			}
+
+			d := Decision{Action: ActionShadowReject}
+			if thisAction != "" {
+				d.ModAction = &ModAction{Action: thisAction, EventID: thisEvent, Pubkey: thisPubkey, Reason: thisReason}
+			}
+			return d
+		}
+	}
+
+	if !relay.DefaultMessagePolicy {
+		if value, ok := load(e.Event.Pubkey); value != "" && ok {
+			if relay.UseWoaForTagged && value == "relay" {
+				allowMessage = true
+			} else if !relay.UseWoaForTagged {
+				allowMessage = true
+			}
+		}
+
+		if relay.AllowTagged {
+			if e.Event.Tags != nil && len(e.Event.Tags) >= 1 {
+				for _, x := range e.Event.Tags {
+					if x[0] == "p" && relay.UseWoaForTagged {
+						if value, ok := load(x[1]); value == "relay" && ok {
+							if value, ok := load(e.Event.Pubkey); value != "" && ok {
+								allowMessage = true
+							}
+						}
+					} else if x[0] == "p" {
+						if value, ok := load(x[1]); value != "" && ok {
+							allowMessage = true
+						}
+					}
+				}
+			}
+		}
+	}
+
+	if relay.AllowList.ListKeywords != nil && len(relay.AllowList.ListKeywords) >= 1 && !relay.DefaultMessagePolicy {
+		foundKeyword := false
+		for _, k := range relay.AllowList.ListKeywords {
+			if strings.Contains(strings.ToLower(e.Event.Content), strings.ToLower(k.Keyword)) {
+				foundKeyword = true
+			}
+		}
+		if relay.AllowKeywordPubkey {
+			if foundKeyword && (allowMessage || IsModAction(relay, e)) {
+				allowMessage = true
+			} else {
+				allowMessage = false
+			}
+		} else {
+			if foundKeyword {
+				allowMessage = true
+			}
+			if IsModAction(relay, e) {
+				allowMessage = true
+			}
+		}
+	} else {
+		if IsModAction(relay, e) {
+			allowMessage = true
+		}
+	}
+
+	if !relay.DefaultMessagePolicy {
+		if relay.AllowList.ListKinds != nil && len(relay.AllowList.ListKinds) >= 1 {
+			if !allowMessage {
+				for _, k := range relay.AllowList.ListKinds {
+					if e.Event.Kind == k.Kind {
+						allowMessage = true
+					}
+				}
+			}
+		}
+	}
+
+	if relay.BlockList.ListPubkeys != nil && len(relay.BlockList.ListPubkeys) >= 1 {
+		for _, k := range relay.BlockList.ListPubkeys {
+			if strings.Contains(k.Pubkey, "npub") {
+				if _, v, err := nip19.Decode(k.Pubkey); err == nil {
+					if strings.Contains(e.Event.Pubkey, v.(string)) {
+						badResp = "blocked pubkey " + k.Pubkey + " reason: " + k.Reason
+						allowMessage = false
+					}
+				}
+			}
+			if strings.Contains(e.Event.Pubkey, k.Pubkey) {
+				badResp = "blocked pubkey " + k.Pubkey + " reason: " + k.Reason
+				allowMessage = false
+			}
+		}
+	}
+
+	if relay.BlockList.ListKeywords != nil && len(relay.BlockList.ListKeywords) >= 1 {
+		for _, k := range relay.BlockList.ListKeywords {
+			if strings.Contains(strings.ToLower(e.Event.Content), strings.ToLower(k.Keyword)) {
+				badResp = "blocked. " + k.Keyword + " reason: " + k.Reason
+				allowMessage = false
+			}
+		}
+	}
+
+	if relay.BlockList.ListKinds != nil && len(relay.BlockList.ListKinds) >= 1 {
+		for _, k := range relay.BlockList.ListKinds {
+			if e.Event.Kind == k.Kind {
+				badResp = "blocked kind " + fmt.Sprintf("%d", k.Kind) + " reason: " + k.Reason
+				allowMessage = false
+			}
+		}
+	}
+
+	if !allowMessage {
+		return Decision{Action: ActionReject, Msg: badResp}
+	}
+	return Decision{Action: ActionAccept}
+}
+
+func testRelay(t *testing.T, config string) Relay {
+	t.Helper()
+	var relay Relay
+	config = strings.NewReplacer("$owner", ownerPub, "$mod", modPub, "$alice", alicePub, "$eve", evePub).Replace(config)
+	if err := json.Unmarshal([]byte(config), &relay); err != nil {
+		t.Fatalf("%s: %v", config, err)
+	}
+	if err := relay.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	return relay
+}
+
+func testEvent(pubkey string, kind int, content string, tags ...[]string) StrfryEvent {
+	var e StrfryEvent
+	e.Event.ID = strings.Repeat("ff", 32)
+	e.Event.Pubkey = pubkey
+	e.Event.Kind = kind
+	e.Event.Content = content
+	e.Event.Tags = tags
+	return e
+}
+
+// relay modes the old loop handled, with the owner and one moderator
+var parityRelays = []struct {
+	name   string
+	config string
+}{
+	{"blacklist", `{"default_message_policy": true, "owner": {"pubkey": "$owner"},
+		"moderators": [{"user": {"pubkey": "$mod"}}]}`},
+	{"blacklist with block lists", `{"default_message_policy": true, "owner": {"pubkey": "$owner"},
+		"block_list": {
+			"list_pubkeys": [{"pubkey": "$eve", "reason": "spammer"}],
+			"list_keywords": [{"keyword": "Casino", "reason": "gambling"}],
+			"list_kinds": [{"kind": 4, "reason": "no dms"}]}}`},
+	{"blacklist npub", `{"default_message_policy": true, "block_list": {
+			"list_pubkeys": [{"pubkey": "NPUB_EVE", "reason": "npub entry"}]}}`},
+	{"whitelist", `{"default_message_policy": false, "owner": {"pubkey": "$owner"},
+		"moderators": [{"user": {"pubkey": "$mod"}}]}`},
+	{"whitelist tagged", `{"default_message_policy": false, "allow_tagged": true,
+		"owner": {"pubkey": "$owner"}}`},
+	{"whitelist woa tagged", `{"default_message_policy": false, "allow_tagged": true,
+		"use_woa_for_tagged": true, "owner": {"pubkey": "$owner"}}`},
+	{"keywords or pubkey", `{"default_message_policy": false, "allow_keyword_pubkey": false,
+		"owner": {"pubkey": "$owner"}, "moderators": [{"user": {"pubkey": "$mod"}}],
+		"allow_list": {"list_keywords": [{"keyword": "Nostr"}]}}`},
+	{"keywords and pubkey", `{"default_message_policy": false, "allow_keyword_pubkey": true,
+		"owner": {"pubkey": "$owner"}, "moderators": [{"user": {"pubkey": "$mod"}}],
+		"allow_list": {"list_keywords": [{"keyword": "Nostr"}]}}`},
+	{"allow kinds", `{"default_message_policy": false, "owner": {"pubkey": "$owner"},
+		"allow_list": {"list_kinds": [{"kind": 7}]}}`},
+	{"whitelist with block lists", `{"default_message_policy": false, "owner": {"pubkey": "$owner"},
+		"moderators": [{"user": {"pubkey": "$mod"}}],
+		"allow_list": {"list_kinds": [{"kind": 4}]},
+		"block_list": {
+			"list_pubkeys": [{"pubkey": "$alice", "reason": "revoked"}],
+			"list_keywords": [{"keyword": "casino", "reason": "gambling"}],
+			"list_kinds": [{"kind": 1984, "reason": "no reports"}, {"kind": 30023, "reason": "no articles"}]}}`},
+}
+
+var parityEvents = []struct {
+	name  string
+	event StrfryEvent
+}{
+	{"note by owner", testEvent(ownerPub, 1, "gm")},
+	{"note by moderator", testEvent(modPub, 1, "gm")},
+	{"note by allow listed", testEvent(alicePub, 1, "gm")},
+	{"note by acl source", testEvent(bobPub, 1, "gm")},
+	{"note by unknown", testEvent(evePub, 1, "gm")},
+	{"keyword by unknown", testEvent(evePub, 1, "talking about nostr")},
+	{"keyword by allow listed", testEvent(alicePub, 1, "NOSTR is great")},
+	{"keyword by moderator", testEvent(modPub, 1, "nostr")},
+	{"blocked keyword", testEvent(bobPub, 1, "best CASINO online")},
+	{"blocked keyword by owner", testEvent(ownerPub, 1, "casino night")},
+	{"dm by unknown", testEvent(evePub, 4, "hi")},
+	{"article by owner", testEvent(ownerPub, 30023, "long form")},
+	{"reaction by unknown", testEvent(evePub, 7, "+", []string{"e", "aa"})},
+	{"unknown tags relay pubkey", testEvent(evePub, 1, "hi", []string{"p", alicePub})},
+	{"acl source tags relay pubkey", testEvent(bobPub, 1, "hi", []string{"p", alicePub})},
+	{"unknown tags acl source", testEvent(evePub, 1, "hi", []string{"p", bobPub})},
+	{"acl source tags acl source", testEvent(bobPub, 1, "hi", []string{"t", "x"}, []string{"p", bobPub})},
+	{"delete reaction by moderator", testEvent(modPub, 7, "❌", []string{"e", "aa"}, []string{"p", evePub})},
+	{"delete reaction without e tag", testEvent(modPub, 7, "❌", []string{"p", evePub})},
+	{"ban reaction by owner", testEvent(ownerPub, 7, "🔨", []string{"e", "aa"}, []string{"p", evePub})},
+	{"ban reaction by unknown", testEvent(evePub, 7, "🔨", []string{"p", alicePub})},
+	{"report of an event", testEvent(modPub, 1984, "", []string{"e", "aa"}, []string{"p", evePub})},
+	{"report of a pubkey", testEvent(ownerPub, 1984, "", []string{"p", evePub})},
+	{"report by unknown", testEvent(evePub, 1984, "", []string{"p", alicePub})},
+}
+
+func TestDefaultPolicyParity(t *testing.T) {
+	npubEve, err := nip19.EncodePublicKey(evePub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range parityRelays {
+		relay := testRelay(t, strings.ReplaceAll(r.config, "NPUB_EVE", npubEve))
+		for _, ev := range parityEvents {
+			want := legacyDecide(ev.event, relay, testACL)
+			got := DefaultPolicy().Decide(ev.event, relay, testACL)
+			if got.Action != want.Action || got.Msg != want.Msg {
+				t.Errorf("%s, %s: got %s %q by %s, want %s %q", r.name, ev.name, got.Action, got.Msg, got.Rule, want.Action, want.Msg)
+				continue
+			}
+			if (got.ModAction == nil) != (want.ModAction == nil) {
+				t.Errorf("%s, %s: got mod action %+v, want %+v", r.name, ev.name, got.ModAction, want.ModAction)
+				continue
+			}
+			if got.ModAction != nil {
+				g, w := got.ModAction, want.ModAction
+				if g.Action != w.Action || g.EventID != w.EventID || g.Pubkey != w.Pubkey {
+					t.Errorf("%s, %s: got mod action %+v, want %+v", r.name, ev.name, g, w)
+				}
+			}
+		}
+	}
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     string
+		event      StrfryEvent
+		wantAction string
+		wantRule   string
+		wantMsg    string
+	}{
+		{"blacklist accepts by default", `{"default_message_policy": true}`,
+			testEvent(evePub, 1, "gm"), ActionAccept, "default_policy", ""},
+		{"whitelist rejects by default", `{"default_message_policy": false}`,
+			testEvent(evePub, 1, "gm"), ActionReject, "default_policy", ""},
+		{"whitelist allows the acl", `{"default_message_policy": false}`,
+			testEvent(bobPub, 1, "gm"), ActionAccept, "allow_pubkey", ""},
+		{"woa tagged only allows the relay acl", `{"default_message_policy": false, "use_woa_for_tagged": true}`,
+			testEvent(bobPub, 1, "gm"), ActionReject, "default_policy", ""},
+		{"allow tagged", `{"default_message_policy": false, "allow_tagged": true}`,
+			testEvent(evePub, 1, "hi", []string{"p", bobPub}), ActionAccept, "allow_tagged", ""},
+		{"moderator", `{"default_message_policy": false, "moderators": [{"user": {"pubkey": "$mod"}}]}`,
+			testEvent(modPub, 1, "gm"), ActionAccept, "moderator", ""},
+		{"keyword and pubkey needs both", `{"default_message_policy": false, "allow_keyword_pubkey": true,
+			"allow_list": {"list_keywords": [{"keyword": "nostr"}]}}`,
+			testEvent(evePub, 1, "nostr"), ActionReject, "allow_keyword", ""},
+		{"keyword or pubkey", `{"default_message_policy": false,
+			"allow_list": {"list_keywords": [{"keyword": "nostr"}]}}`,
+			testEvent(evePub, 1, "nostr"), ActionAccept, "allow_keyword", ""},
+		{"allow kind", `{"default_message_policy": false, "allow_list": {"list_kinds": [{"kind": 7}]}}`,
+			testEvent(evePub, 7, "+"), ActionAccept, "allow_kind", ""},
+		{"block pubkey beats the acl", `{"default_message_policy": false,
+			"block_list": {"list_pubkeys": [{"pubkey": "$alice", "reason": "revoked"}]}}`,
+			testEvent(alicePub, 1, "gm"), ActionReject, "block_pubkey", "blocked pubkey " + alicePub + " reason: revoked"},
+		{"block keyword", `{"default_message_policy": true,
+			"block_list": {"list_keywords": [{"keyword": "casino", "reason": "gambling"}]}}`,
+			testEvent(evePub, 1, "CASINO"), ActionReject, "block_keyword", "blocked. casino reason: gambling"},
+		{"block kind beats the owner", `{"default_message_policy": true, "owner": {"pubkey": "$owner"},
+			"block_list": {"list_kinds": [{"kind": 4, "reason": "no dms"}]}}`,
+			testEvent(ownerPub, 4, "hi"), ActionReject, "block_kind", "blocked kind 4 reason: no dms"},
+		{"mod action is shadow rejected", `{"default_message_policy": true, "owner": {"pubkey": "$owner"}}`,
+			testEvent(ownerPub, 7, "❌", []string{"e", "aa"}), ActionShadowReject, "mod_action", ""},
+	}
+	for _, tt := range tests {
+		relay := testRelay(t, tt.config)
+		d := DefaultPolicy().Decide(tt.event, relay, testACL)
+		if d.Action != tt.wantAction || d.Rule != tt.wantRule || d.Msg != tt.wantMsg {
+			t.Errorf("%s: got %s %q by %s, want %s %q by %s", tt.name, d.Action, d.Msg, d.Rule, tt.wantAction, tt.wantMsg, tt.wantRule)
+		}
+	}
+}
+
+func TestPolicyLog(t *testing.T) {
+	relay := testRelay(t, `{"default_message_policy": true, "block_list": {"list_keywords": [{"keyword": "casino"}]}}`)
+	var lines []string
+	p := DefaultPolicy()
+	p.Log = func(s string) { lines = append(lines, s) }
+	p.Decide(testEvent(evePub, 1, "casino"), relay, MapACL{})
+	if len(lines) != 1 || lines[0] != "rejecting for keyword: casino" {
+		t.Errorf("logged %q", lines)
+	}
+
+	// a policy without a logger is quiet
+	p.Log = nil
+	p.Decide(testEvent(evePub, 1, "casino"), relay, MapACL{})
+}
+
+func TestPolicyNormalize(t *testing.T) {
+	relay := testRelay(t, `{"default_message_policy": true, "block_list": {"list_keywords": [{"keyword": "spam"}]}}`)
+	e := testEvent(evePub, 1, "ѕраm") // cyrillic lookalikes
+
+	p := DefaultPolicy()
+	if d := p.Decide(e, relay, MapACL{}); d.Action != ActionReject {
+		t.Errorf("normalized: got %s, want reject", d.Action)
+	}
+	p.Normalize = false
+	if d := p.Decide(e, relay, MapACL{}); d.Action != ActionAccept {
+		t.Errorf("not normalized: got %s, want accept", d.Action)
+	}
+}
+
+func TestPrepareErrors(t *testing.T) {
+	var relay Relay
+	err := json.Unmarshal([]byte(`{"block_list": {
+		"list_keywords": [{"keyword": "(", "match_mode": "regex"}],
+		"list_pubkeys": [{"pubkey": "abc", "expires_at": "next tuesday"}]}}`), &relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = relay.Prepare()
+	if err == nil {
+		t.Fatal("want errors for the bad pattern and expiry")
+	}
+	for _, want := range []string{"error compiling keyword (", "block_list.list_pubkeys[0]"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+	if relay.Version() == "" {
+		t.Error("the relay is still usable and has a version")
+	}
+}
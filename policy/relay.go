@@ -0,0 +1,396 @@
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// Strfry Events (FROM STDIN)
+type StrfryEvent struct {
+	Event struct {
+		Content   string     `json:"content"`
+		CreatedAt int        `json:"created_at"`
+		ID        string     `json:"id"`
+		Kind      int        `json:"kind"`
+		Pubkey    string     `json:"pubkey"`
+		Sig       string     `json:"sig"`
+		Tags      [][]string `json:"tags"`
+	} `json:"event"`
+	ReceivedAt int    `json:"receivedAt"`
+	SourceInfo string `json:"sourceInfo"`
+	SourceType string `json:"sourceType"`
+	Type       string `json:"type"`
+}
+
+// Strfry Actions
+type StrfryResult struct {
+	ID     string `json:"id"`     // event id
+	Action string `json:"action"` // accept or reject
+	Msg    string `json:"msg"`    // sent to client for reject
+}
+
+// Relay Creator Schema
+type Relay struct {
+	ID                   string `json:"id"`
+	Name                 string `json:"name"`
+	OwnerID              string `json:"ownerId"`
+	DefaultMessagePolicy bool   `json:"default_message_policy"`
+	AllowGiftwrap        bool   `json:"allow_giftwrap"`
+	AllowTagged          bool   `json:"allow_tagged"`
+	AllowKeywordPubkey   bool   `json:"allow_keyword_pubkey"`
+	UseWoaForTagged      bool   `json:"use_woa_for_tagged"`
+	AllowList            struct {
+		ID           string `json:"id"`
+		RelayID      string `json:"relayId"`
+		ListKeywords []struct {
+			ID          string      `json:"id"`
+			AllowListID string      `json:"AllowListId"`
+			BlockListID interface{} `json:"BlockListId"`
+			Keyword     string      `json:"keyword"`
+			MatchMode   string      `json:"match_mode"`
+			Reason      string      `json:"reason"`
+			ExpiresAt   Expiry      `json:"expires_at"`
+		} `json:"list_keywords"`
+		ListPubkeys []ListPubkey `json:"list_pubkeys"`
+		ListKinds   []struct {
+			ID          string      `json:"id"`
+			AllowListID string      `json:"AllowListId"`
+			BlockListID interface{} `json:"BlockListId"`
+			Kind        int         `json:"kind"`
+			Reason      string      `json:"reason"`
+		} `json:"list_kinds"`
+		ListTags []ListTag `json:"list_tags"`
+	} `json:"allow_list"`
+	BlockList struct {
+		ID           string `json:"id"`
+		RelayID      string `json:"relayId"`
+		ListKeywords []struct {
+			ID          string      `json:"id"`
+			AllowListID interface{} `json:"AllowListId"`
+			BlockListID string      `json:"BlockListId"`
+			Keyword     string      `json:"keyword"`
+			MatchMode   string      `json:"match_mode"`
+			Reason      string      `json:"reason"`
+			ExpiresAt   Expiry      `json:"expires_at"`
+		} `json:"list_keywords"`
+		ListPubkeys []struct {
+			ID          string      `json:"id"`
+			AllowListID interface{} `json:"AllowListId"`
+			BlockListID string      `json:"BlockListId"`
+			Pubkey      string      `json:"pubkey"`
+			Reason      string      `json:"reason"`
+			ExpiresAt   Expiry      `json:"expires_at"`
+		} `json:"list_pubkeys"`
+		ListKinds []struct {
+			ID          string      `json:"id"`
+			AllowListID string      `json:"AllowListId"`
+			BlockListID interface{} `json:"BlockListId"`
+			Kind        int         `json:"kind"`
+			Reason      string      `json:"reason"`
+		} `json:"list_kinds"`
+		ListTags []ListTag `json:"list_tags"`
+	} `json:"block_list"`
+	Owner struct {
+		ID     string      `json:"id"`
+		Pubkey string      `json:"pubkey"`
+		Name   interface{} `json:"name"`
+	} `json:"owner"`
+
+	Moderators []struct {
+		ID      string `json:"id"`
+		RelayID string `json:"relayId"`
+		UserID  string `json:"userId"`
+		User    struct {
+			Pubkey string `json:"pubkey"`
+		} `json:"user"`
+	} `json:"moderators"`
+
+	AclSources []AclSource `json:"acl_sources"`
+
+	RateLimits          []RateLimit   `json:"rate_limits"`
+	RateLimitExemptMods bool          `json:"rate_limit_exempt_mods"`
+	IPRateLimits        []IPRateLimit `json:"ip_rate_limits"`
+
+	PowDifficulty   int       `json:"pow_difficulty"`
+	PowKinds        []PowKind `json:"pow_kinds"`
+	PowAdaptive     bool      `json:"pow_adaptive"`
+	PowAdaptiveRate int       `json:"pow_adaptive_rate"` // events per minute before difficulty goes up
+	PowAdaptiveMax  int       `json:"pow_adaptive_max"`  // most extra bits added
+
+	MaxFutureSeconds          int `json:"max_future_seconds"`
+	MaxPastSeconds            int `json:"max_past_seconds"`
+	MaxPastSecondsReplaceable int `json:"max_past_seconds_replaceable"`
+
+	EventLimits        []EventLimits `json:"event_limits"`
+	BlockBinaryContent bool          `json:"block_binary_content"`
+
+	// precompiled list keywords, see Prepare
+	keywords map[string]*keywordMatcher
+	version  string
+}
+
+type ListPubkey struct {
+	ID          string      `json:"id"`
+	AllowListID string      `json:"AllowListId"`
+	BlockListID interface{} `json:"BlockListId"`
+	Pubkey      string      `json:"pubkey"`
+	Reason      string      `json:"reason"`
+	ExpiresAt   Expiry      `json:"expires_at"`
+}
+
+// ListTag matches events carrying a tag value, like ["t", "bitcoin"].
+// Tag defaults to "t".
+type ListTag struct {
+	ID          string      `json:"id"`
+	AllowListID interface{} `json:"AllowListId"`
+	BlockListID interface{} `json:"BlockListId"`
+	Tag         string      `json:"tag"`
+	Value       string      `json:"value"`
+	Reason      string      `json:"reason"`
+	ExpiresAt   Expiry      `json:"expires_at"`
+}
+
+// Name is the tag letter, "t" when not set
+func (l ListTag) Name() string {
+	if l.Tag == "" {
+		return "t"
+	}
+	return l.Tag
+}
+
+// Matches reports whether any of the event tags carry this tag value.
+// Hashtags are compared case insensitively and without a leading #.
+func (l ListTag) Matches(tags [][]string) bool {
+	name := l.Name()
+	value := l.Value
+	if name == "t" {
+		value = strings.TrimPrefix(value, "#")
+	}
+	for _, x := range tags {
+		if len(x) < 2 || x[0] != name {
+			continue
+		}
+		if name == "t" {
+			if strings.EqualFold(strings.TrimPrefix(x[1], "#"), value) {
+				return true
+			}
+		} else if x[1] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Expiry is the expires_at of a list entry, the zero value never expires
+type Expiry struct {
+	time.Time
+
+	// why the value could not be parsed, see Err
+	err error
+}
+
+// UnmarshalJSON accepts null, an RFC3339 timestamp or unix seconds /
+// milliseconds. Anything else is treated as never expiring, so one bad
+// entry does not break loading the relay, and is reported by Err.
+func (x *Expiry) UnmarshalJSON(b []byte) error {
+	x.Time = time.Time{}
+	x.err = nil
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch t := v.(type) {
+	case nil:
+	case string:
+		if t == "" {
+			return nil
+		}
+		parsed, err := time.Parse(time.RFC3339, t)
+		if err != nil {
+			x.err = fmt.Errorf("error parsing expires_at %s: %w", t, err)
+			return nil
+		}
+		x.Time = parsed
+	case float64:
+		// anything this large is milliseconds
+		if t > 1e12 {
+			x.Time = time.UnixMilli(int64(t))
+		} else {
+			x.Time = time.Unix(int64(t), 0)
+		}
+	default:
+		x.err = fmt.Errorf("error parsing expires_at %s", string(b))
+	}
+	return nil
+}
+
+func (x Expiry) MarshalJSON() ([]byte, error) {
+	if x.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(x.Time.UTC().Format(time.RFC3339))
+}
+
+// Expired reports whether the entry has expired at now
+func (x Expiry) Expired(now time.Time) bool {
+	return !x.IsZero() && !now.Before(x.Time)
+}
+
+// Err is the parse error of an expires_at that was ignored, nil when it
+// was valid
+func (x Expiry) Err() error {
+	return x.err
+}
+
+type AclSource struct {
+	ID      string `json:"id"`
+	RelayID string `json:"relayId"`
+	AclType string `json:"aclType"`
+	Url     string `json:"url"`
+}
+
+// DecodePub returns the hex form of an npub, other pubkeys are returned as
+// they are
+func DecodePub(pubkey string) string {
+	usepub := pubkey
+	if strings.Contains(pubkey, "npub") {
+		if _, v, err := nip19.Decode(pubkey); err == nil {
+			usepub = v.(string)
+		}
+	}
+	return usepub
+}
+
+// Prepare precompiles the list keywords and fingerprints the config, call
+// it whenever a new relay config is loaded. The returned errors are the
+// keywords and expires_at values that could not be used, the relay is
+// still usable: invalid patterns never match and bad expiries never expire.
+func (relay *Relay) Prepare() error {
+	errs := relay.compileKeywords()
+	check := func(list string, i int, x Expiry) {
+		if err := x.Err(); err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d]: %w", list, i, err))
+		}
+	}
+	for i, k := range relay.AllowList.ListKeywords {
+		check("allow_list.list_keywords", i, k.ExpiresAt)
+	}
+	for i, p := range relay.AllowList.ListPubkeys {
+		check("allow_list.list_pubkeys", i, p.ExpiresAt)
+	}
+	for i, t := range relay.AllowList.ListTags {
+		check("allow_list.list_tags", i, t.ExpiresAt)
+	}
+	for i, k := range relay.BlockList.ListKeywords {
+		check("block_list.list_keywords", i, k.ExpiresAt)
+	}
+	for i, p := range relay.BlockList.ListPubkeys {
+		check("block_list.list_pubkeys", i, p.ExpiresAt)
+	}
+	for i, t := range relay.BlockList.ListTags {
+		check("block_list.list_tags", i, t.ExpiresAt)
+	}
+
+	b, _ := json.Marshal(relay)
+	sum := sha256.Sum256(b)
+	relay.version = hex.EncodeToString(sum[:8])
+	return errors.Join(errs...)
+}
+
+// Version identifies the relay config a decision was made with
+func (relay *Relay) Version() string {
+	return relay.version
+}
+
+// IsModAction reports whether the event is from the owner or a moderator
+func IsModAction(relay Relay, e StrfryEvent) bool {
+	return IsModerator(relay, e.Event.Pubkey)
+}
+
+// IsModerator reports whether pubkey is the owner or a moderator
+func IsModerator(relay Relay, pubkey string) bool {
+	isMod := false
+	for _, m := range relay.Moderators {
+		usepub := DecodePub(m.User.Pubkey)
+		if usepub == pubkey {
+			isMod = true
+		}
+	}
+	if relay.Owner.Pubkey == pubkey {
+		isMod = true
+	}
+	return isMod
+}
+
+// RateLimit is a token bucket budget for a kind or range of kinds, from the
+// relay config. A single kind has KindFrom == KindTo.
+type RateLimit struct {
+	KindFrom  int     `json:"kind_from"`
+	KindTo    int     `json:"kind_to"`
+	PerMinute float64 `json:"per_minute"` // tokens refilled per minute
+	Burst     int     `json:"burst"`      // bucket size
+}
+
+// Matches reports whether the limit applies to kind
+func (l RateLimit) Matches(kind int) bool {
+	return kind >= l.KindFrom && kind <= l.KindTo
+}
+
+func (l RateLimit) String() string {
+	if l.KindFrom == l.KindTo {
+		return fmt.Sprintf("kind %d", l.KindFrom)
+	}
+	return fmt.Sprintf("kinds %d-%d", l.KindFrom, l.KindTo)
+}
+
+// IPRateLimit is a token bucket budget per client address. Addresses are
+// grouped by prefix, so 24 / 64 throttle a whole /24 or /64 together; zero
+// means the full address.
+type IPRateLimit struct {
+	PerMinute  float64 `json:"per_minute"`
+	Burst      int     `json:"burst"`
+	IPv4Prefix int     `json:"ipv4_prefix"`
+	IPv6Prefix int     `json:"ipv6_prefix"`
+}
+
+// Key returns the bucket key for addr under this limit
+func (l IPRateLimit) Key(addr netip.Addr) string {
+	bits := addr.BitLen()
+	if addr.Is4() && l.IPv4Prefix > 0 && l.IPv4Prefix < bits {
+		bits = l.IPv4Prefix
+	} else if addr.Is6() && l.IPv6Prefix > 0 && l.IPv6Prefix < bits {
+		bits = l.IPv6Prefix
+	}
+	p, _ := addr.Prefix(bits)
+	return p.String()
+}
+
+// EventLimits caps the size of events for a kind or range of kinds. The
+// first entry matching the event kind applies, zero disables a limit.
+type EventLimits struct {
+	KindFrom          int `json:"kind_from"`
+	KindTo            int `json:"kind_to"`
+	MaxContentBytes   int `json:"max_content_bytes"`
+	MaxTags           int `json:"max_tags"`
+	MaxTagValueLength int `json:"max_tag_value_length"`
+	MaxEventBytes     int `json:"max_event_bytes"` // serialized event
+}
+
+// Matches reports whether the limits apply to kind
+func (l EventLimits) Matches(kind int) bool {
+	return kind >= l.KindFrom && kind <= l.KindTo
+}
+
+// PowKind overrides the minimum proof of work for one kind
+type PowKind struct {
+	Kind       int `json:"kind"`
+	Difficulty int `json:"difficulty"`
+}
@@ -0,0 +1,156 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ReportConfig is the kind 1984 report handling
+type ReportConfig struct {
+	Actions        string // type=action pairs, comma separated
+	DefaultAction  string // for types not in Actions
+	TimeoutSeconds int    // how long the timeout action lasts
+}
+
+// what a moderator's report of a given NIP-56 type does
+const (
+	ReportDelete  = "delete"  // delete the reported event, ban when only a pubkey is reported
+	ReportBan     = "ban"     // ban the pubkey and delete its events
+	ReportTimeout = "timeout" // reject the pubkey's new events for a while and delete the reported event
+	ReportLog     = "log"     // only record it in the moderation history
+)
+
+func validReportAction(action string) bool {
+	return action == ReportDelete || action == ReportBan || action == ReportTimeout || action == ReportLog
+}
+
+// ReportPolicy maps report types (nudity, malware, profanity, illegal,
+// spam, impersonation, other) to actions
+type ReportPolicy struct {
+	actions        map[string]string
+	defaultAction  string
+	timeoutSeconds int
+}
+
+func NewReportPolicy(cfg ReportConfig) (*ReportPolicy, error) {
+	p := &ReportPolicy{
+		actions:        make(map[string]string),
+		defaultAction:  strings.ToLower(strings.TrimSpace(cfg.DefaultAction)),
+		timeoutSeconds: cfg.TimeoutSeconds,
+	}
+	if p.defaultAction == "" {
+		p.defaultAction = ReportDelete
+	}
+	if !validReportAction(p.defaultAction) {
+		return nil, fmt.Errorf("unknown default report action %q", cfg.DefaultAction)
+	}
+	for _, pair := range strings.Split(cfg.Actions, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		t, action, found := strings.Cut(pair, "=")
+		t = strings.ToLower(strings.TrimSpace(t))
+		action = strings.ToLower(strings.TrimSpace(action))
+		if !found || t == "" || !validReportAction(action) {
+			return nil, fmt.Errorf("report action %q is not type=delete|ban|timeout|log", pair)
+		}
+		p.actions[t] = action
+	}
+	if p.timeoutSeconds <= 0 && p.uses(ReportTimeout) {
+		return nil, fmt.Errorf("report timeout of %d seconds is not a positive duration", cfg.TimeoutSeconds)
+	}
+	return p, nil
+}
+
+// uses reports whether any report type maps to action
+func (p *ReportPolicy) uses(action string) bool {
+	if p.defaultAction == action {
+		return true
+	}
+	for _, a := range p.actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// action returns the action for a report type
+func (p *ReportPolicy) action(reportType string) string {
+	if p == nil {
+		return ReportDelete
+	}
+	if a, ok := p.actions[strings.ToLower(reportType)]; ok {
+		return a
+	}
+	return p.defaultAction
+}
+
+// modAction turns a moderator's kind 1984 report into a mod action, nil when
+// it reports nothing. The report type is the third element of the e or p
+// tag. With both, the event is what is reported and the p tag is its
+// author. Moderators are never banned or timed out.
+func (p *ReportPolicy) modAction(ev *Evaluation) *ModAction {
+	e := ev.Event
+	var eventID, pubkey, reportType string
+	for _, x := range e.Event.Tags {
+		if len(x) < 2 {
+			continue
+		}
+		if x[0] == "e" && eventID == "" {
+			eventID = x[1]
+			if len(x) >= 3 && x[2] != "" {
+				reportType = x[2]
+			}
+		}
+		if x[0] == "p" && pubkey == "" {
+			pubkey = x[1]
+			if len(x) >= 3 && x[2] != "" && reportType == "" {
+				reportType = x[2]
+			}
+		}
+	}
+	if eventID == "" && pubkey == "" {
+		return nil
+	}
+	if reportType == "" {
+		reportType = "other"
+	}
+
+	by := "mod action by " + e.Event.Pubkey + ": "
+	a := &ModAction{Moderator: e.Event.Pubkey, EventID: eventID, Pubkey: pubkey, ModEventID: e.Event.ID}
+	action := p.action(reportType)
+	if action == ReportDelete && eventID == "" {
+		// nothing to delete but the pubkey
+		action = ReportBan
+	}
+	if (action == ReportBan || action == ReportTimeout) && pubkey == "" {
+		// the author of the event is not known
+		ev.Logf("report %s of %s has no p tag, deleting the event only", reportType, eventID)
+		action = ReportDelete
+	}
+	if (action == ReportBan || action == ReportTimeout) && IsModerator(*ev.Relay, DecodePub(pubkey)) {
+		ev.Logf("not banning or timing out moderator %s", pubkey)
+		if eventID == "" {
+			return nil
+		}
+		action = ReportDelete
+	}
+
+	switch action {
+	case ReportDelete:
+		a.Action = "deleteEvent"
+		a.Reason = by + "delete event, report " + reportType
+	case ReportBan:
+		a.Action = "blockAndDeletePubkey"
+		a.Reason = by + "block and delete pubkey, report " + reportType
+	case ReportTimeout:
+		a.Action = "timeoutPubkey"
+		a.DurationSeconds = p.timeoutSeconds
+		a.Reason = by + "timeout pubkey, report " + reportType
+	case ReportLog:
+		a.Action = "logReport"
+		a.Reason = by + "report " + reportType
+	}
+	return a
+}
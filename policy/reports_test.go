@@ -0,0 +1,49 @@
+package policy
+
+import (
+	"testing"
+)
+
+func TestNewReportPolicyTimeoutSeconds(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ReportConfig
+		wantErr bool
+	}{
+		{"timeout default", ReportConfig{DefaultAction: ReportTimeout, TimeoutSeconds: 60}, false},
+		{"zero timeout default", ReportConfig{DefaultAction: ReportTimeout}, true},
+		{"negative timeout type", ReportConfig{Actions: "spam=timeout", TimeoutSeconds: -1}, true},
+		{"zero without timeouts", ReportConfig{Actions: "spam=ban"}, false},
+		{"unknown action", ReportConfig{Actions: "spam=explode", TimeoutSeconds: 60}, true},
+	}
+	for _, tt := range tests {
+		_, err := NewReportPolicy(tt.cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReportDuration(t *testing.T) {
+	relay := testRelay(t, `{"default_message_policy": true, "owner": {"pubkey": "$owner"}}`)
+	rule := ModActionRule{Timeouts: TimeoutConfig{Seconds: 3600}}
+	tests := []struct {
+		name       string
+		event      StrfryEvent
+		wantAction string
+		wantPubkey string
+	}{
+		{"duration times out", testEvent(ownerPub, 1984, "", []string{"e", "aa"}, []string{"p", evePub, "spam"}, []string{"duration", "2h"}),
+			"timeoutPubkey", evePub},
+		{"no p tag is a report", testEvent(ownerPub, 1984, "", []string{"e", "aa", "spam"}, []string{"duration", "2h"}),
+			"deleteEvent", ""},
+		{"bad duration is a report", testEvent(ownerPub, 1984, "", []string{"p", evePub, "spam"}, []string{"duration", "soon"}),
+			"blockAndDeletePubkey", evePub},
+	}
+	for _, tt := range tests {
+		d := NewPolicy(rule).Decide(tt.event, relay, MapACL{})
+		if d.ModAction == nil || d.ModAction.Action != tt.wantAction || d.ModAction.Pubkey != tt.wantPubkey {
+			t.Errorf("%s: got %+v, want %s %q", tt.name, d.ModAction, tt.wantAction, tt.wantPubkey)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// ModActionRule handles moderation commands from the owner and moderators:
+// kind 1984 reports and ❌ / 🔨 reactions. Mod actions are never published,
+// they are silently dropped with shadowReject. Reports are handled by type
+// as set in Reports, every report deletes the event when it is nil. The
+// timeout reaction and reports with a duration tag time out the pubkey.
+type ModActionRule struct {
+	Reports  *ReportPolicy
+	Timeouts TimeoutConfig
+}
+
+func (ModActionRule) Name() string { return "mod_action" }
+
+func (r ModActionRule) Evaluate(ev *Evaluation) {
+	e := ev.Event
+	isTimeout := e.Event.Kind == 7 && r.Timeouts.Reaction != "" && e.Event.Content == r.Timeouts.Reaction
+	if !(e.Event.Kind == 1984 || isTimeout || (e.Event.Kind == 7 && (e.Event.Content == "❌" || e.Event.Content == "🔨"))) {
+		return
+	}
+	if !IsModAction(*ev.Relay, e) {
+		return
+	}
+	if isTimeout {
+		ev.Logf("timeout request from %s", e.Event.Pubkey)
+		ev.Finish(Decision{Action: ActionShadowReject, Rule: r.Name(), ModAction: r.Timeouts.timeoutAction(ev)})
+		return
+	}
+
+	thisReason := ""
+	thisEvent := ""
+	thisPubkey := ""
+	thisAction := ""
+
+	if e.Event.Kind == 1984 {
+		ev.Logf("1984 request from %s>", e.Event.Pubkey)
+		if _, ok := durationTag(ev, e.Event.Tags); ok {
+			// a report with a duration is a timeout whatever its type, when
+			// it says who to time out
+			if firstTag(e.Event.Tags, "p") != "" {
+				ev.Finish(Decision{Action: ActionShadowReject, Rule: r.Name(), ModAction: r.Timeouts.timeoutAction(ev)})
+				return
+			}
+			ev.Logf("report %s has a duration but no p tag, handling it as a report", e.Event.ID)
+		}
+		ev.Finish(Decision{Action: ActionShadowReject, Rule: r.Name(), ModAction: r.Reports.modAction(ev)})
+		return
+	} else if e.Event.Kind == 7 && e.Event.Content == "❌" {
+		// delete event
+		for _, x := range e.Event.Tags {
+			if len(x) >= 2 && x[0] == "e" {
+				thisEvent = x[1]
+				thisReason = "mod action by " + e.Event.Pubkey + ": delete event"
+			}
+		}
+		if thisEvent != "" {
+			thisAction = "deleteEvent"
+		}
+	} else if e.Event.Kind == 7 && e.Event.Content == "🔨" {
+		// delete the events related to this pubkey
+		for _, x := range e.Event.Tags {
+			if len(x) >= 2 && x[0] == "p" {
+				thisPubkey = x[1]
+				thisReason = "mod action by " + e.Event.Pubkey + ": block and delete pubkey"
+			}
+		}
+		if thisPubkey != "" {
+			thisAction = "blockAndDeletePubkey"
+		}
+	}
+
+	d := Decision{Action: ActionShadowReject, Rule: r.Name()}
+	if thisAction != "" {
+		d.ModAction = &ModAction{
+			Action:     thisAction,
+			EventID:    thisEvent,
+			Pubkey:     thisPubkey,
+			Moderator:  e.Event.Pubkey,
+			Reason:     thisReason,
+			ModEventID: e.Event.ID,
+		}
+	}
+	ev.Finish(d)
+}
+
+// AllowPubkeyRule allows pubkeys found in the ACL when the relay is in
+// whitelist mode (default_message_policy=false)
+type AllowPubkeyRule struct{}
+
+func (AllowPubkeyRule) Name() string { return "allow_pubkey" }
+
+func (r AllowPubkeyRule) Evaluate(ev *Evaluation) {
+	if ev.Relay.DefaultMessagePolicy {
+		return
+	}
+	e := ev.Event
+	if value, ok := ev.ACL.Source(e.Event.Pubkey); ok {
+		// if use woa for tagged, only allow if it's from the relay ACL
+		if ev.Relay.UseWoaForTagged && value == "relay" {
+			ev.Logf("WOATAGS:enabled allowing whitelist for %s from source:%s", e.Event.Pubkey, value)
+			ev.Accept(r.Name())
+		} else if !ev.Relay.UseWoaForTagged {
+			ev.Logf("WOATAGS:disabled allowing whitelist for %s from source:%s", e.Event.Pubkey, value)
+			ev.Accept(r.Name())
+		}
+	}
+}
+
+// AllowTaggedRule allows events that tag a whitelisted pubkey when
+// allow_tagged is set
+type AllowTaggedRule struct{}
+
+func (AllowTaggedRule) Name() string { return "allow_tagged" }
+
+func (r AllowTaggedRule) Evaluate(ev *Evaluation) {
+	if ev.Relay.DefaultMessagePolicy || !ev.Relay.AllowTagged {
+		return
+	}
+	e := ev.Event
+	for _, x := range e.Event.Tags {
+		if len(x) < 2 {
+			continue
+		}
+
+		// if we are using woa for tagged, check if the tag is tagging someone in the relay ACL,
+		// then check that the pubkey tagging is in the whitelist
+		if x[0] == "p" && ev.Relay.UseWoaForTagged {
+			if value, ok := ev.ACL.Source(x[1]); value == "relay" && ok {
+				if value, ok := ev.ACL.Source(e.Event.Pubkey); ok {
+					ev.Logf("WOA: allowing whitelist for tagged pubkey: %s, %s ", x[1], value)
+					ev.Accept(r.Name())
+				}
+			}
+		} else if x[0] == "p" {
+			if value, ok := ev.ACL.Source(x[1]); ok {
+				ev.Logf("allowing whitelist for tagged pubkey: %s, %s ", x[1], value)
+				ev.Accept(r.Name())
+			} else {
+				ev.Logf("we didnt find a match for %s", x[1])
+			}
+		}
+	}
+}
+
+// AllowKeywordRule applies the allow list keywords when the relay is in
+// whitelist mode
+type AllowKeywordRule struct{}
+
+func (AllowKeywordRule) Name() string { return "allow_keyword" }
+
+func (r AllowKeywordRule) Evaluate(ev *Evaluation) {
+	if !keywordMode(ev.Relay) {
+		return
+	}
+	e := ev.Event
+	// relay has whitelist keywords, allow  messages matching any of these keywords to post, deny messages that don't.
+	// If they're allow_listed pubkey, we check the setting for allow_keyword_pubkey.
+	// If allow_keyword_pubkey is 'true' still want to obey the keyword list here and only allow the keywords.
+	// Else if allow_keyword_pubkey is 'false' we will allow the message if it matches the keyword list.
+	foundKeyword := false
+	now := time.Now()
+	for _, k := range ev.Relay.AllowList.ListKeywords {
+		if k.ExpiresAt.Expired(now) {
+			continue
+		}
+		if ev.matchKeyword(k.Keyword, k.MatchMode) {
+			ev.Logf("found keyword: %s", k.Keyword)
+			foundKeyword = true
+		}
+	}
+	ev.Logf("allow_keyword_pubkey: %t", ev.Relay.AllowKeywordPubkey)
+
+	if ev.Relay.AllowKeywordPubkey {
+		if foundKeyword && (ev.Allow || IsModAction(*ev.Relay, e)) {
+			ev.Logf("allow_keyword_pubkey=true, allowMessage=true, allowing for BOTH")
+			ev.Accept(r.Name())
+		} else {
+			ev.Logf("allow_keyword_pubkey=true, keyword AND pubkey not found, deny")
+			ev.Deny(r.Name())
+		}
+	} else {
+		if foundKeyword {
+			ev.Logf("allow_keyword_pubkey=false, pubkey allowed OR keyword allowed, allow")
+			ev.Accept(r.Name())
+		}
+		// mod allowance check is required here, in keyword mode with allow_keyword_pubkey set to false
+		if IsModAction(*ev.Relay, e) {
+			ev.Logf("allowing for mod: %s", e.Event.Pubkey)
+			ev.Accept("moderator")
+		}
+	}
+}
+
+// ModeratorRule allows owner + moderators. The one specific case you
+// wouldn't want to allow owner+mods is in AllowList keywords mode, which
+// AllowKeywordRule handles itself.
+type ModeratorRule struct{}
+
+func (ModeratorRule) Name() string { return "moderator" }
+
+func (r ModeratorRule) Evaluate(ev *Evaluation) {
+	if keywordMode(ev.Relay) {
+		return
+	}
+	if IsModAction(*ev.Relay, ev.Event) {
+		ev.Logf("allowing for mod: %s", ev.Event.Event.Pubkey)
+		ev.Accept(r.Name())
+	}
+}
+
+// firstTag returns the value of the first name tag, empty when there is none
+func firstTag(tags [][]string, name string) string {
+	for _, x := range tags {
+		if len(x) >= 2 && x[0] == name {
+			return x[1]
+		}
+	}
+	return ""
+}
+
+// keywordMode is true when a whitelist mode relay has unexpired allow list
+// keywords
+func keywordMode(relay *Relay) bool {
+	if relay.DefaultMessagePolicy {
+		return false
+	}
+	now := time.Now()
+	for _, k := range relay.AllowList.ListKeywords {
+		if !k.ExpiresAt.Expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowKindRule allows kinds from the allow list when the relay is in
+// whitelist mode and nothing above allowed the event
+type AllowKindRule struct{}
+
+func (AllowKindRule) Name() string { return "allow_kind" }
+
+func (r AllowKindRule) Evaluate(ev *Evaluation) {
+	if ev.Relay.DefaultMessagePolicy || ev.Allow {
+		return
+	}
+	for _, k := range ev.Relay.AllowList.ListKinds {
+		if ev.Event.Event.Kind == k.Kind {
+			ev.Accept(r.Name())
+		}
+	}
+}
+
+// AllowTagRule allows events carrying an allow list tag value, from anyone,
+// when the relay is in whitelist mode and nothing above allowed the event
+type AllowTagRule struct{}
+
+func (AllowTagRule) Name() string { return "allow_tag" }
+
+func (r AllowTagRule) Evaluate(ev *Evaluation) {
+	if ev.Relay.DefaultMessagePolicy || ev.Allow {
+		return
+	}
+	now := time.Now()
+	for _, t := range ev.Relay.AllowList.ListTags {
+		if t.ExpiresAt.Expired(now) {
+			continue
+		}
+		if t.Matches(ev.Event.Event.Tags) {
+			ev.Logf("allowing for tag %s:%s", t.Name(), t.Value)
+			ev.Accept(r.Name())
+			return
+		}
+	}
+}
+
+// BlockPubkeyRule rejects block listed pubkeys, overriding the ACLs above it
+type BlockPubkeyRule struct{}
+
+func (BlockPubkeyRule) Name() string { return "block_pubkey" }
+
+func (r BlockPubkeyRule) Evaluate(ev *Evaluation) {
+	e := ev.Event
+	// relay is in blacklist pubkey mode, mark bad
+	now := time.Now()
+	for _, k := range ev.Relay.BlockList.ListPubkeys {
+		if k.ExpiresAt.Expired(now) {
+			continue
+		}
+		if strings.Contains(k.Pubkey, "npub") {
+			if _, v, err := nip19.Decode(k.Pubkey); err == nil {
+				pub := v.(string)
+				if strings.Contains(e.Event.Pubkey, pub) {
+					ev.Logf("rejecting for pubkey: %s", k.Pubkey)
+					ev.Reject(r.Name(), "blocked pubkey "+k.Pubkey+" reason: "+k.Reason)
+				}
+			} else {
+				ev.Logf("error decoding pubkey: %s %s", k.Pubkey, err.Error())
+			}
+		}
+		if strings.Contains(e.Event.Pubkey, k.Pubkey) {
+			ev.Logf("rejecting for pubkey: %s", k.Pubkey)
+			ev.Reject(r.Name(), "blocked pubkey "+k.Pubkey+" reason: "+k.Reason)
+		}
+	}
+}
+
+// BlockKeywordRule rejects content matching block list keywords
+type BlockKeywordRule struct{}
+
+func (BlockKeywordRule) Name() string { return "block_keyword" }
+
+func (r BlockKeywordRule) Evaluate(ev *Evaluation) {
+	// relay has blacklist keywords, deny messages matching any of these keywords to post
+	now := time.Now()
+	for _, k := range ev.Relay.BlockList.ListKeywords {
+		if k.ExpiresAt.Expired(now) {
+			continue
+		}
+		if ev.matchKeyword(k.Keyword, k.MatchMode) {
+			ev.Logf("rejecting for keyword: %s", k.Keyword)
+			ev.Reject(r.Name(), "blocked. "+k.Keyword+" reason: "+k.Reason)
+		}
+	}
+}
+
+// BlockTagRule rejects events carrying a block list tag value
+type BlockTagRule struct{}
+
+func (BlockTagRule) Name() string { return "block_tag" }
+
+func (r BlockTagRule) Evaluate(ev *Evaluation) {
+	now := time.Now()
+	for _, t := range ev.Relay.BlockList.ListTags {
+		if t.ExpiresAt.Expired(now) {
+			continue
+		}
+		if t.Matches(ev.Event.Event.Tags) {
+			ev.Logf("rejecting for tag %s:%s", t.Name(), t.Value)
+			ev.Reject(r.Name(), "blocked tag "+t.Value+" reason: "+t.Reason)
+		}
+	}
+}
+
+// BlockKindRule rejects block listed kinds, overriding all other ACLs
+type BlockKindRule struct{}
+
+func (BlockKindRule) Name() string { return "block_kind" }
+
+func (r BlockKindRule) Evaluate(ev *Evaluation) {
+	for _, k := range ev.Relay.BlockList.ListKinds {
+		if ev.Event.Event.Kind == k.Kind {
+			ev.Reject(r.Name(), "blocked kind "+fmt.Sprintf("%d", k.Kind)+" reason: "+k.Reason)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package policy
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeoutConfig is the moderator timeout handling
+type TimeoutConfig struct {
+	Reaction   string // reaction that times out the author, empty turns it off
+	Seconds    int    // without a duration tag
+	MaxSeconds int    // longest duration tag honoured, 0 no limit
+}
+
+// parseTimeoutDuration reads a duration tag value: seconds, a Go duration
+// like 90m, or days like 2d
+func parseTimeoutDuration(v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+	if n, err := strconv.Atoi(v); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+	return time.ParseDuration(v)
+}
+
+// durationTag returns the duration tag of a mod event, found is false when
+// there is none or it is not a positive duration
+func durationTag(ev *Evaluation, tags [][]string) (d time.Duration, found bool) {
+	for _, x := range tags {
+		if len(x) >= 2 && x[0] == "duration" {
+			d, err := parseTimeoutDuration(x[1])
+			if err != nil || d <= 0 {
+				ev.Logf("ignoring duration tag %q: not a positive duration", x[1])
+				return 0, false
+			}
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// timeoutAction times out the p tagged pubkey for the duration tag or the
+// default duration. The reported event is not deleted. nil when there is
+// no pubkey to time out.
+func (cfg TimeoutConfig) timeoutAction(ev *Evaluation) *ModAction {
+	e := ev.Event
+	var pubkey string
+	for _, x := range e.Event.Tags {
+		if len(x) >= 2 && x[0] == "p" {
+			pubkey = DecodePub(x[1])
+			break
+		}
+	}
+	if pubkey == "" {
+		return nil
+	}
+	if IsModerator(*ev.Relay, pubkey) {
+		ev.Logf("not timing out moderator %s", pubkey)
+		return nil
+	}
+
+	d := time.Duration(cfg.Seconds) * time.Second
+	if tagged, ok := durationTag(ev, e.Event.Tags); ok {
+		d = tagged
+	}
+	if max := time.Duration(cfg.MaxSeconds) * time.Second; max > 0 && d > max {
+		d = max
+	}
+	if d <= 0 {
+		return nil
+	}
+	return &ModAction{
+		Action:          "timeoutPubkey",
+		Pubkey:          pubkey,
+		Moderator:       e.Event.Pubkey,
+		Reason:          "mod action by " + e.Event.Pubkey + ": timeout pubkey for " + d.String(),
+		ModEventID:      e.Event.ID,
+		DurationSeconds: int(d / time.Second),
+	}
+}
@@ -0,0 +1,66 @@
+package policy
+
+import (
+	"time"
+)
+
+// replaceable kinds keep only the latest event per pubkey (NIP-01)
+func isReplaceable(kind int) bool {
+	return kind == 0 || kind == 3 || (kind >= 10000 && kind < 20000)
+}
+
+// addressable kinds keep only the latest event per pubkey and d tag (NIP-01)
+func isAddressable(kind int) bool {
+	return kind >= 30000 && kind < 40000
+}
+
+// receivedAt returns when strfry received the event. strfry may report
+// microseconds, zero falls back to now.
+func receivedAt(e StrfryEvent) time.Time {
+	r := int64(e.ReceivedAt)
+	switch {
+	case r <= 0:
+		return time.Now()
+	case r > 1e15:
+		return time.UnixMicro(r)
+	case r > 1e12:
+		return time.UnixMilli(r)
+	}
+	return time.Unix(r, 0)
+}
+
+// CreatedAtRule rejects events dated too far in the future or the past
+// relative to when they were received. Replaceable and addressable kinds
+// have their own past limit, since a profile or list can legitimately be
+// old, and Sync / Import events are never too old. Zero disables a limit.
+type CreatedAtRule struct{}
+
+func (CreatedAtRule) Name() string { return "created_at" }
+
+func (r CreatedAtRule) Evaluate(ev *Evaluation) {
+	if !ev.Allow {
+		return
+	}
+	relay := ev.Relay
+	e := ev.Event
+	received := receivedAt(e)
+	created := time.Unix(int64(e.Event.CreatedAt), 0)
+
+	if relay.MaxFutureSeconds > 0 && created.Sub(received) > time.Duration(relay.MaxFutureSeconds)*time.Second {
+		ev.Logf("rejecting event %s dated %s in the future", e.Event.ID, created.Sub(received))
+		ev.Reject(r.Name(), "invalid: created_at is too far in the future")
+		return
+	}
+
+	if e.SourceType == "Sync" || e.SourceType == "Import" {
+		return
+	}
+	maxPast := relay.MaxPastSeconds
+	if isReplaceable(e.Event.Kind) || isAddressable(e.Event.Kind) {
+		maxPast = relay.MaxPastSecondsReplaceable
+	}
+	if maxPast > 0 && received.Sub(created) > time.Duration(maxPast)*time.Second {
+		ev.Logf("rejecting event %s dated %s in the past", e.Event.ID, received.Sub(created))
+		ev.Reject(r.Name(), "invalid: created_at is too far in the past")
+	}
+}
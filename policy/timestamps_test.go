@@ -0,0 +1,70 @@
+package policy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCreatedAtRule(t *testing.T) {
+	relay := testRelay(t, `{"default_message_policy": true, "max_future_seconds": 900,
+		"max_past_seconds": 86400, "max_past_seconds_replaceable": 0}`)
+	received := time.Unix(1700000000, 0)
+	hour := int(time.Hour / time.Second)
+
+	tests := []struct {
+		name       string
+		kind       int
+		created    int // seconds after received
+		receivedAt int
+		sourceType string
+		want       string
+	}{
+		{"now", 1, 0, 0, "IP4", ActionAccept},
+		{"future within the window", 1, 900, 0, "IP4", ActionAccept},
+		{"too far in the future", 1, 901, 0, "IP4", ActionReject},
+		{"future from a sync", 1, 2 * hour, 0, "Sync", ActionReject},
+		{"past within the window", 1, -24 * hour, 0, "IP4", ActionAccept},
+		{"too far in the past", 1, -24*hour - 1, 0, "IP4", ActionReject},
+		{"old sync", 1, -365 * 24 * hour, 0, "Sync", ActionAccept},
+		{"old import", 1, -365 * 24 * hour, 0, "Import", ActionAccept},
+		{"old replaceable, no limit", 0, -365 * 24 * hour, 0, "IP4", ActionAccept},
+		{"old addressable, no limit", 30023, -365 * 24 * hour, 0, "IP4", ActionAccept},
+		{"received in microseconds", 1, 901, 1700000000 * 1000000, "IP4", ActionReject},
+		{"received in milliseconds", 1, 900, 1700000000 * 1000, "IP4", ActionAccept},
+	}
+	for _, tt := range tests {
+		e := testEvent(alicePub, tt.kind, "hi")
+		e.SourceType = tt.sourceType
+		e.Event.CreatedAt = int(received.Unix()) + tt.created
+		e.ReceivedAt = tt.receivedAt
+		if e.ReceivedAt == 0 {
+			e.ReceivedAt = int(received.Unix())
+		}
+		if d := NewPolicy(CreatedAtRule{}).Decide(e, relay, MapACL{}); d.Action != tt.want {
+			t.Errorf("%s: %s (%s), want %s", tt.name, d.Action, d.Msg, tt.want)
+		}
+	}
+
+	// a replaceable past limit of its own
+	relay = testRelay(t, `{"default_message_policy": true, "max_past_seconds": 3600,
+		"max_past_seconds_replaceable": 86400}`)
+	for _, tt := range []struct {
+		kind    int
+		created int
+		want    string
+	}{
+		{1, -2 * hour, ActionReject},
+		{0, -2 * hour, ActionAccept},
+		{10002, -2 * hour, ActionAccept},
+		{30023, -2 * hour, ActionAccept},
+		{3, -25 * hour, ActionReject},
+		{20000, -2 * hour, ActionReject}, // ephemeral, not replaceable
+	} {
+		e := testEvent(alicePub, tt.kind, "hi")
+		e.ReceivedAt = int(received.Unix())
+		e.Event.CreatedAt = int(received.Unix()) + tt.created
+		if d := NewPolicy(CreatedAtRule{}).Decide(e, relay, MapACL{}); d.Action != tt.want {
+			t.Errorf("kind %d %ds old: %s, want %s", tt.kind, -tt.created, d.Action, tt.want)
+		}
+	}
+}
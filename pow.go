@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+)
+
+// powDifficulty counts the leading zero bits of an event id (NIP-13). When
+// the nonce tag commits to a lower target that is used instead, so lucky
+// ids do not count for more than the work that went into them.
+func powDifficulty(id string, tags [][]string) int {
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return 0
+	}
+	zeros := 0
+	for _, c := range b {
+		if c == 0 {
+			zeros += 8
+			continue
+		}
+		zeros += bits.LeadingZeros8(c)
+		break
+	}
+	for _, x := range tags {
+		if len(x) >= 3 && x[0] == "nonce" {
+			if target, err := strconv.Atoi(x[2]); err == nil && target < zeros {
+				return target
+			}
+		}
+	}
+	return zeros
+}
+
+// eventRate counts events per second in one second buckets over the last
+// minute
+type eventRate struct {
+	mu      sync.Mutex
+	buckets [60]int
+	last    int64
+}
+
+func (r *eventRate) add(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.advance(now.Unix())
+	r.buckets[now.Unix()%60]++
+}
+
+// perMinute returns the number of events over the last minute
+func (r *eventRate) perMinute(now time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.advance(now.Unix())
+	total := 0
+	for _, c := range r.buckets {
+		total += c
+	}
+	return total
+}
+
+// advance clears the buckets for seconds that passed since the last call
+func (r *eventRate) advance(sec int64) {
+	if sec-r.last >= 60 {
+		r.buckets = [60]int{}
+	} else {
+		for s := r.last + 1; s <= sec; s++ {
+			r.buckets[s%60] = 0
+		}
+	}
+	if sec > r.last {
+		r.last = sec
+	}
+}
+
+// PowRule requires NIP-13 proof of work. pow_difficulty applies to all
+// kinds unless pow_kinds has an entry for the kind. With pow_adaptive the
+// requirement goes up one bit each time the event rate doubles over
+// pow_adaptive_rate events per minute, up to pow_adaptive_max extra bits.
+// The rate counts events still allowed when they get here, those already
+// rejected and the moderators' are not counted. Pubkeys on the ACL and
+// moderators are exempt.
+type PowRule struct {
+	rate eventRate
+}
+
+func NewPowRule() *PowRule {
+	return &PowRule{}
+}
+
+func (*PowRule) Name() string { return "pow" }
+
+func (r *PowRule) Evaluate(ev *policy.Evaluation) {
+	if !ev.Allow || policy.IsModAction(*ev.Relay, ev.Event) {
+		return
+	}
+	now := time.Now()
+	if !ev.DryRun {
+		r.rate.add(now)
+	}
+
+	required := requiredPow(ev.Relay, ev.Event.Event.Kind)
+	if ev.Relay.PowAdaptive {
+		required += adaptivePow(ev.Relay, r.rate.perMinute(now))
+	}
+	if required <= 0 {
+		return
+	}
+	e := ev.Event.Event
+	if _, ok := ev.ACL.Source(e.Pubkey); ok {
+		return
+	}
+	if got := powDifficulty(e.ID, e.Tags); got < required {
+		ev.Logf("rejecting for pow %d < %d from %s", got, required, e.Pubkey)
+		ev.Reject(r.Name(), fmt.Sprintf("pow: difficulty %d is less than %d", got, required))
+	}
+}
+
+func requiredPow(relay *policy.Relay, kind int) int {
+	for _, k := range relay.PowKinds {
+		if k.Kind == kind {
+			return k.Difficulty
+		}
+	}
+	return relay.PowDifficulty
+}
+
+// adaptivePow is the extra difficulty for the current event rate
+func adaptivePow(relay *policy.Relay, perMinute int) int {
+	if relay.PowAdaptiveRate <= 0 || perMinute <= relay.PowAdaptiveRate {
+		return 0
+	}
+	extra := 1 + int(math.Log2(float64(perMinute)/float64(relay.PowAdaptiveRate)))
+	if relay.PowAdaptiveMax > 0 && extra > relay.PowAdaptiveMax {
+		extra = relay.PowAdaptiveMax
+	}
+	return extra
+}
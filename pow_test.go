@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+)
+
+func TestPowDifficulty(t *testing.T) {
+	id := func(prefix string) string {
+		return prefix + strings.Repeat("f", 64-len(prefix))
+	}
+	tests := []struct {
+		name string
+		id   string
+		tags [][]string
+		want int
+	}{
+		{"no zeros", id("f"), nil, 0},
+		{"one zero nibble", id("0f"), nil, 4},
+		{"leading zero bits in a byte", id("01"), nil, 7},
+		{"two zero bytes", id("00007"), nil, 17},
+		{"all zeros", strings.Repeat("0", 64), nil, 256},
+		{"not hex", "zz", nil, 0},
+		{"nonce target lower", id("00000"), [][]string{{"nonce", "1", "16"}}, 16},
+		{"nonce target higher", id("0000f"), [][]string{{"nonce", "1", "30"}}, 16},
+		{"nonce target equal", id("0000f"), [][]string{{"nonce", "1", "16"}}, 16},
+		{"nonce without target", id("0000f"), [][]string{{"nonce", "1"}}, 16},
+		{"nonce target not a number", id("0000f"), [][]string{{"nonce", "1", "x"}}, 16},
+	}
+	for _, tt := range tests {
+		if got := powDifficulty(tt.id, tt.tags); got != tt.want {
+			t.Errorf("%s: powDifficulty(%s) = %d, want %d", tt.name, tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestPowRateCountsAllowedEvents(t *testing.T) {
+	owner := strings.Repeat("0c", 32)
+	alice := strings.Repeat("0a", 32)
+	relay := policy.Relay{ID: "r1", DefaultMessagePolicy: true, PowAdaptive: true, PowAdaptiveRate: 1}
+	relay.Owner.Pubkey = owner
+	r := NewPowRule()
+
+	evaluate := func(pubkey string, allow bool, dryRun bool) *policy.Evaluation {
+		ev := &policy.Evaluation{Relay: &relay, ACL: policy.MapACL{}, Allow: allow, DryRun: dryRun}
+		ev.Event.Event.ID = strings.Repeat("f", 64)
+		ev.Event.Event.Kind = 1
+		ev.Event.Event.Pubkey = pubkey
+		r.Evaluate(ev)
+		return ev
+	}
+	for i := 0; i < 5; i++ {
+		evaluate(alice, false, false) // already rejected
+		evaluate(owner, true, false)  // moderator
+		evaluate(alice, true, true)   // dry run
+	}
+	if n := r.rate.perMinute(time.Now()); n != 0 {
+		t.Fatalf("rate = %d, want rejected, moderator and dry run events not counted", n)
+	}
+
+	if ev := evaluate(alice, true, false); !ev.Allow {
+		t.Fatalf("first event rejected at rate 0: %s", ev.Msg)
+	}
+	if ev := evaluate(alice, true, false); ev.Allow {
+		t.Error("second event allowed, want one extra bit required over 1 event per minute")
+	}
+	if n := r.rate.perMinute(time.Now()); n != 2 {
+		t.Errorf("rate = %d, want 2", n)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+)
+
+type tokenBucket struct {
+	tokens    float64
+	last      time.Time
+	perMinute float64
+	burst     int
+}
+
+// take refills the bucket for the time passed and takes one token if there
+// is one available
+func (b *tokenBucket) take(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Minutes() * b.perMinute
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket would be back at burst by now, at which
+// point it can be forgotten
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Minutes()*b.perMinute >= float64(b.burst)
+}
+
+// peek reports whether take would succeed, without taking a token
+func (b tokenBucket) peek(now time.Time) bool {
+	return b.take(now)
+}
+
+// bucketSet is a set of token buckets keyed by string, idle buckets are
+// swept out every so often
+type bucketSet struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	calls   int
+}
+
+func newBucketSet() *bucketSet {
+	return &bucketSet{buckets: make(map[string]*tokenBucket)}
+}
+
+// take takes a token from the bucket for key, the budget is updated in
+// place so config changes apply to existing buckets
+func (s *bucketSet) take(key string, now time.Time, perMinute float64, burst int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls++
+	if s.calls%1000 == 0 {
+		for k, b := range s.buckets {
+			if b.full(now) {
+				delete(s.buckets, k)
+			}
+		}
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	}
+	b.perMinute = perMinute
+	b.burst = burst
+	return b.take(now)
+}
+
+// peek reports whether take would succeed for key, without changing any
+// bucket
+func (s *bucketSet) peek(key string, now time.Time, perMinute float64, burst int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[key]
+	if !ok {
+		return burst >= 1
+	}
+	c := *b
+	c.perMinute = perMinute
+	c.burst = burst
+	return c.peek(now)
+}
+
+// try takes a token, or only checks for one on a dry run
+func (s *bucketSet) try(dryRun bool, key string, now time.Time, perMinute float64, burst int) bool {
+	if dryRun {
+		return s.peek(key, now, perMinute, burst)
+	}
+	return s.take(key, now, perMinute, burst)
+}
+
+// RateLimitRule applies the relay's per pubkey, per kind rate limits. The
+// first rate limit matching the event kind is used.
+type RateLimitRule struct {
+	buckets *bucketSet
+}
+
+func NewRateLimitRule() *RateLimitRule {
+	return &RateLimitRule{buckets: newBucketSet()}
+}
+
+func (*RateLimitRule) Name() string { return "rate_limit" }
+
+func (r *RateLimitRule) Evaluate(ev *policy.Evaluation) {
+	if !ev.Allow || len(ev.Relay.RateLimits) == 0 {
+		return
+	}
+	if ev.Relay.RateLimitExemptMods && policy.IsModAction(*ev.Relay, ev.Event) {
+		return
+	}
+	e := ev.Event.Event
+	for _, l := range ev.Relay.RateLimits {
+		if !l.Matches(e.Kind) {
+			continue
+		}
+		key := fmt.Sprintf("%s:%d-%d", e.Pubkey, l.KindFrom, l.KindTo)
+		if !r.buckets.try(ev.DryRun, key, time.Now(), l.PerMinute, l.Burst) {
+			ev.Logf("rate limiting %s for %s", e.Pubkey, l)
+			ev.Reject(r.Name(), "rate-limited: slow down, too many "+l.String()+" events")
+		}
+		return
+	}
+}
+
+// sourceAddr returns the client address of events that came in over a
+// websocket. Import, Sync and Stream events have no client address.
+func sourceAddr(e policy.StrfryEvent) (netip.Addr, bool, error) {
+	if e.SourceType != "IP4" && e.SourceType != "IP6" {
+		return netip.Addr{}, false, nil
+	}
+	addr, err := netip.ParseAddr(e.SourceInfo)
+	if err != nil {
+		return netip.Addr{}, false, err
+	}
+	return addr.Unmap(), true, nil
+}
+
+// IPRateLimitRule applies the relay's per address rate limits. Every limit
+// is applied, so a per address budget and a per /24 budget can be combined.
+// Every event from the address takes a token, including ones already
+// rejected, so throwaway key spam from one host is throttled.
+type IPRateLimitRule struct {
+	buckets   *bucketSet
+	badSource sync.Once
+}
+
+func NewIPRateLimitRule() *IPRateLimitRule {
+	return &IPRateLimitRule{buckets: newBucketSet()}
+}
+
+func (*IPRateLimitRule) Name() string { return "ip_rate_limit" }
+
+func (r *IPRateLimitRule) Evaluate(ev *policy.Evaluation) {
+	if len(ev.Relay.IPRateLimits) == 0 {
+		return
+	}
+	addr, ok, err := sourceAddr(ev.Event)
+	if err != nil {
+		// every event would log the same, once is enough to notice
+		r.badSource.Do(func() {
+			ev.Logf("could not parse source address %s, not rate limiting it by address: %s", ev.Event.SourceInfo, err.Error())
+		})
+	}
+	if !ok {
+		return
+	}
+	now := time.Now()
+	for i, l := range ev.Relay.IPRateLimits {
+		key := fmt.Sprintf("%d:%s", i, l.Key(addr))
+		if !r.buckets.try(ev.DryRun, key, now, l.PerMinute, l.Burst) && ev.Allow {
+			ev.Logf("rate limiting address %s (%s)", addr, l.Key(addr))
+			ev.Reject(r.Name(), "rate-limited: slow down, too many events from your address")
+		}
+	}
+}
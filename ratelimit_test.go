@@ -0,0 +1,179 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+)
+
+func rateLimitEvent(pubkey string, kind int) policy.StrfryEvent {
+	var e policy.StrfryEvent
+	e.Type = "new"
+	e.Event.ID = strings.Repeat("2", 64)
+	e.Event.Kind = kind
+	e.Event.Pubkey = pubkey
+	return e
+}
+
+func fromAddr(e policy.StrfryEvent, sourceType string, addr string) policy.StrfryEvent {
+	e.SourceType = sourceType
+	e.SourceInfo = addr
+	return e
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	b := &tokenBucket{tokens: 2, last: start, perMinute: 60, burst: 2}
+	steps := []struct {
+		after time.Duration
+		want  bool
+	}{
+		{0, true},
+		{0, true},
+		{0, false},
+		{500 * time.Millisecond, false},
+		{time.Second, true},
+		{time.Second, false},
+		// a long wait refills only up to the burst
+		{time.Hour, true},
+		{time.Hour, true},
+		{time.Hour, false},
+	}
+	for i, s := range steps {
+		if got := b.take(start.Add(s.after)); got != s.want {
+			t.Errorf("step %d: take after %s = %t, want %t", i, s.after, got, s.want)
+		}
+	}
+	if !b.full(start.Add(2 * time.Hour)) {
+		t.Error("bucket not full after an hour idle")
+	}
+}
+
+func TestRateLimitPerKind(t *testing.T) {
+	relay := policy.Relay{ID: "r1", DefaultMessagePolicy: true, RateLimits: []policy.RateLimit{
+		{KindFrom: 1, KindTo: 1, PerMinute: 1, Burst: 1},
+		{KindFrom: 7, KindTo: 7, PerMinute: 1, Burst: 2},
+		// never reached for kind 1, the first match is used
+		{KindFrom: 0, KindTo: 10, PerMinute: 1, Burst: 100},
+	}}
+	alice := strings.Repeat("0a", 32)
+	bob := strings.Repeat("0b", 32)
+	p := policy.NewPolicy(NewRateLimitRule())
+
+	steps := []struct {
+		pubkey string
+		kind   int
+		want   string
+	}{
+		{alice, 1, policy.ActionAccept},
+		{alice, 1, policy.ActionReject},
+		{alice, 7, policy.ActionAccept},
+		{alice, 7, policy.ActionAccept},
+		{alice, 7, policy.ActionReject},
+		{alice, 3, policy.ActionAccept},
+		{alice, 30023, policy.ActionAccept},
+		{bob, 1, policy.ActionAccept},
+	}
+	for i, s := range steps {
+		if d := p.Decide(rateLimitEvent(s.pubkey, s.kind), relay, policy.MapACL{}); d.Action != s.want {
+			t.Errorf("step %d: kind %d = %s, want %s", i, s.kind, d.Action, s.want)
+		}
+	}
+}
+
+func TestRateLimitExemptMods(t *testing.T) {
+	owner := strings.Repeat("0c", 32)
+	relay := policy.Relay{ID: "r1", DefaultMessagePolicy: true, RateLimits: []policy.RateLimit{
+		{KindFrom: 0, KindTo: 65535, PerMinute: 1, Burst: 1},
+	}}
+	relay.Owner.Pubkey = owner
+	p := policy.NewPolicy(NewRateLimitRule())
+
+	for i := 0; i < 3; i++ {
+		if d := p.Decide(rateLimitEvent(owner, 1), relay, policy.MapACL{}); i > 0 && d.Action != policy.ActionReject {
+			t.Errorf("event %d from the owner without the exemption = %s, want reject", i, d.Action)
+		}
+	}
+	relay.RateLimitExemptMods = true
+	for i := 0; i < 3; i++ {
+		if d := p.Decide(rateLimitEvent(owner, 1), relay, policy.MapACL{}); d.Action != policy.ActionAccept {
+			t.Errorf("event %d from the exempt owner = %s, want accept", i, d.Action)
+		}
+	}
+}
+
+func TestRateLimitDryRun(t *testing.T) {
+	alice := strings.Repeat("0a", 32)
+	relay := policy.Relay{ID: "r1", DefaultMessagePolicy: true,
+		RateLimits:   []policy.RateLimit{{KindFrom: 1, KindTo: 1, PerMinute: 1, Burst: 1}},
+		IPRateLimits: []policy.IPRateLimit{{PerMinute: 1, Burst: 1}},
+	}
+	p := policy.NewPolicy(NewRateLimitRule(), NewIPRateLimitRule())
+	e := fromAddr(rateLimitEvent(alice, 1), "IP4", "192.0.2.1")
+
+	for i := 0; i < 3; i++ {
+		if d := p.DecideDryRun(e, relay, policy.MapACL{}); d.Action != policy.ActionAccept {
+			t.Fatalf("dry run %d = %s, want accept without using up the budget", i, d.Action)
+		}
+	}
+	if d := p.Decide(e, relay, policy.MapACL{}); d.Action != policy.ActionAccept {
+		t.Fatalf("first event = %s, want accept", d.Action)
+	}
+	if d := p.DecideDryRun(e, relay, policy.MapACL{}); d.Action != policy.ActionReject {
+		t.Errorf("dry run after the budget is used = %s, want reject", d.Action)
+	}
+}
+
+func TestIPRateLimitPrefixes(t *testing.T) {
+	relay := policy.Relay{ID: "r1", DefaultMessagePolicy: true, IPRateLimits: []policy.IPRateLimit{
+		{PerMinute: 1, Burst: 1, IPv4Prefix: 24, IPv6Prefix: 64},
+	}}
+	tests := []struct {
+		name        string
+		source      string
+		first, then string
+		want        string
+	}{
+		{"same /24", "IP4", "192.0.2.1", "192.0.2.200", policy.ActionReject},
+		{"other /24", "IP4", "192.0.2.1", "192.0.3.1", policy.ActionAccept},
+		{"mapped IPv4 in the same /24", "IP6", "192.0.2.1", "::ffff:192.0.2.9", policy.ActionReject},
+		{"same /64", "IP6", "2001:db8:1:2::1", "2001:db8:1:2:ffff::1", policy.ActionReject},
+		{"other /64", "IP6", "2001:db8:1:2::1", "2001:db8:1:3::1", policy.ActionAccept},
+		{"not parsed", "IP4", "192.0.2.1", "not an address", policy.ActionAccept},
+	}
+	alice := strings.Repeat("0a", 32)
+	for _, tt := range tests {
+		p := policy.NewPolicy(NewIPRateLimitRule())
+		first := fromAddr(rateLimitEvent(alice, 1), "IP4", tt.first)
+		if d := p.Decide(first, relay, policy.MapACL{}); d.Action != policy.ActionAccept {
+			t.Fatalf("%s: first event = %s, want accept", tt.name, d.Action)
+		}
+		then := fromAddr(rateLimitEvent(alice, 1), tt.source, tt.then)
+		if d := p.Decide(then, relay, policy.MapACL{}); d.Action != tt.want {
+			t.Errorf("%s: event from %s = %s, want %s", tt.name, tt.then, d.Action, tt.want)
+		}
+	}
+
+	// events without a client address are not limited by address
+	p := policy.NewPolicy(NewIPRateLimitRule())
+	for i := 0; i < 3; i++ {
+		if d := p.Decide(fromAddr(rateLimitEvent(alice, 1), "Sync", ""), relay, policy.MapACL{}); d.Action != policy.ActionAccept {
+			t.Errorf("sync event %d = %s, want accept", i, d.Action)
+		}
+	}
+}
+
+func TestSourceAddrLoggedOnce(t *testing.T) {
+	relay := policy.Relay{ID: "r1", DefaultMessagePolicy: true, IPRateLimits: []policy.IPRateLimit{{PerMinute: 1, Burst: 1}}}
+	var logged []string
+	p := policy.NewPolicy(NewIPRateLimitRule())
+	p.Log = func(s string) { logged = append(logged, s) }
+	for i := 0; i < 3; i++ {
+		p.Decide(fromAddr(rateLimitEvent(strings.Repeat("0a", 32), 1), "IP4", "bogus"), relay, policy.MapACL{})
+	}
+	if len(logged) != 1 {
+		t.Errorf("logged %q, want one line", logged)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"gopkg.in/yaml.v3"
+)
+
+// loadRelayFile reads the relay policy from a local YAML or JSON file, in
+// the same schema the relay.tools API returns. Unknown fields and invalid
+// values are errors, so typos do not silently change the policy.
+func loadRelayFile(path string) (policy.Relay, error) {
+	var relay policy.Relay
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return relay, err
+	}
+
+	// YAML is converted to JSON, so the json tags and decoders apply
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		var v interface{}
+		if err := yaml.Unmarshal(body, &v); err != nil {
+			return relay, fmt.Errorf("%s: %w", path, err)
+		}
+		body, err = json.Marshal(v)
+		if err != nil {
+			return relay, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&relay); err != nil {
+		return relay, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validateRelay(&relay); err != nil {
+		return relay, fmt.Errorf("%s: invalid relay config:\n%w", path, err)
+	}
+	return relay, nil
+}
+
+// fetchRelayConfig loads the relay from the local file when one is
+// configured, otherwise from the API. On error the old relay is returned.
+func fetchRelayConfig(s *settings, old policy.Relay) (policy.Relay, error) {
+	if s.relayFile == "" {
+		return queryRelay(s.apiURL, old)
+	}
+	relay, err := loadRelayFile(s.relayFile)
+	if err != nil {
+		log(err.Error())
+		return old, err
+	}
+	return relay, nil
+}
+
+// pollInterval is how often the relay config is fetched
+func (s *settings) pollInterval() time.Duration {
+	if s.relayFile != "" && s.relayFilePoll > 0 {
+		return time.Duration(s.relayFilePoll) * time.Second
+	}
+	return 60 * time.Second
+}
+
+func validPubkey(pubkey string) bool {
+	if strings.HasPrefix(pubkey, "npub") {
+		_, _, err := nip19.Decode(pubkey)
+		return err == nil
+	}
+	b, err := hex.DecodeString(pubkey)
+	return err == nil && len(b) == 32
+}
+
+func validKind(kind int) bool {
+	return kind >= 0 && kind <= 65535
+}
+
+// validateRelay checks the relay config for values the rules cannot use
+// and returns every problem found
+func validateRelay(relay *policy.Relay) error {
+	var errs []error
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	if relay.Owner.Pubkey != "" && !validPubkey(relay.Owner.Pubkey) {
+		add("owner.pubkey: %q is not a hex pubkey or npub", relay.Owner.Pubkey)
+	}
+	for i, m := range relay.Moderators {
+		if !validPubkey(m.User.Pubkey) {
+			add("moderators[%d].user.pubkey: %q is not a hex pubkey or npub", i, m.User.Pubkey)
+		}
+	}
+
+	for i, p := range relay.AllowList.ListPubkeys {
+		if !validPubkey(p.Pubkey) {
+			add("allow_list.list_pubkeys[%d]: %q is not a hex pubkey or npub", i, p.Pubkey)
+		}
+	}
+	for i, p := range relay.BlockList.ListPubkeys {
+		if !validPubkey(p.Pubkey) {
+			add("block_list.list_pubkeys[%d]: %q is not a hex pubkey or npub", i, p.Pubkey)
+		}
+	}
+
+	checkKeyword := func(list string, i int, keyword string, mode string) {
+		if keyword == "" {
+			add("%s.list_keywords[%d]: keyword is empty", list, i)
+			return
+		}
+		if err := policy.ValidKeyword(keyword, mode); err != nil {
+			add("%s.list_keywords[%d]: %v", list, i, err)
+		}
+	}
+	for i, k := range relay.AllowList.ListKeywords {
+		checkKeyword("allow_list", i, k.Keyword, k.MatchMode)
+	}
+	for i, k := range relay.BlockList.ListKeywords {
+		checkKeyword("block_list", i, k.Keyword, k.MatchMode)
+	}
+
+	for i, k := range relay.AllowList.ListKinds {
+		if !validKind(k.Kind) {
+			add("allow_list.list_kinds[%d]: kind %d is out of range", i, k.Kind)
+		}
+	}
+	for i, k := range relay.BlockList.ListKinds {
+		if !validKind(k.Kind) {
+			add("block_list.list_kinds[%d]: kind %d is out of range", i, k.Kind)
+		}
+	}
+
+	singleLetter := regexp.MustCompile(`^[a-zA-Z]$`)
+	checkTag := func(list string, i int, t policy.ListTag) {
+		if t.Tag != "" && !singleLetter.MatchString(t.Tag) {
+			add("%s.list_tags[%d]: tag %q is not a single letter", list, i, t.Tag)
+		}
+		if t.Value == "" {
+			add("%s.list_tags[%d]: value is empty", list, i)
+		}
+	}
+	for i, t := range relay.AllowList.ListTags {
+		checkTag("allow_list", i, t)
+	}
+	for i, t := range relay.BlockList.ListTags {
+		checkTag("block_list", i, t)
+	}
+
+	for i, as := range relay.AclSources {
+		if as.ID == "" {
+			add("acl_sources[%d]: id is empty", i)
+		}
+		if as.Url == "" {
+			add("acl_sources[%d]: url is empty", i)
+		}
+		if as.AclType != "grapevine" && as.AclType != "brainstorm" && as.AclType != "nip05" {
+			add("acl_sources[%d]: unknown aclType %q, expected grapevine, brainstorm or nip05", i, as.AclType)
+		}
+	}
+
+	for i, l := range relay.RateLimits {
+		if !validKind(l.KindFrom) || !validKind(l.KindTo) || l.KindFrom > l.KindTo {
+			add("rate_limits[%d]: kind range %d-%d is invalid", i, l.KindFrom, l.KindTo)
+		}
+		if l.PerMinute <= 0 || l.Burst < 1 {
+			add("rate_limits[%d]: per_minute must be above 0 and burst at least 1", i)
+		}
+	}
+	for i, l := range relay.IPRateLimits {
+		if l.PerMinute <= 0 || l.Burst < 1 {
+			add("ip_rate_limits[%d]: per_minute must be above 0 and burst at least 1", i)
+		}
+		if l.IPv4Prefix < 0 || l.IPv4Prefix > 32 {
+			add("ip_rate_limits[%d]: ipv4_prefix %d is out of range", i, l.IPv4Prefix)
+		}
+		if l.IPv6Prefix < 0 || l.IPv6Prefix > 128 {
+			add("ip_rate_limits[%d]: ipv6_prefix %d is out of range", i, l.IPv6Prefix)
+		}
+	}
+
+	if relay.PowDifficulty < 0 || relay.PowDifficulty > 256 {
+		add("pow_difficulty: %d is out of range", relay.PowDifficulty)
+	}
+	for i, k := range relay.PowKinds {
+		if !validKind(k.Kind) || k.Difficulty < 0 || k.Difficulty > 256 {
+			add("pow_kinds[%d]: kind %d difficulty %d is invalid", i, k.Kind, k.Difficulty)
+		}
+	}
+
+	for i, l := range relay.EventLimits {
+		if !validKind(l.KindFrom) || !validKind(l.KindTo) || l.KindFrom > l.KindTo {
+			add("event_limits[%d]: kind range %d-%d is invalid", i, l.KindFrom, l.KindTo)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/jeremyd/spamblaster/policy"
+	"github.com/spf13/viper"
+)
+
+const apiConfigFile = "./spamblaster.cfg"
+
+// influxWriter writes a point per decision to influxdb
+type influxWriter struct {
+	client      influxdb2.Client
+	writeAPI    api.WriteAPI
+	measurement string
+}
+
+// newInfluxWriter returns nil when influxdb is not configured
+func newInfluxWriter(cfg influxdbConfig) *influxWriter {
+	if cfg.Token == "" && cfg.Url == "" && cfg.Bucket == "" {
+		return nil
+	}
+	client := influxdb2.NewClientWithOptions(cfg.Url, cfg.Token,
+		influxdb2.DefaultOptions().SetBatchSize(20))
+	return &influxWriter{
+		client: client,
+		// Get non-blocking write client
+		writeAPI:    client.WriteAPI(cfg.Org, cfg.Bucket),
+		measurement: cfg.Measurement,
+	}
+}
+
+func (w *influxWriter) write(e policy.StrfryEvent, decision policy.Decision, relay *policy.Relay) {
+	blocked := 0
+	allowed := 1
+	spam := 0
+	invalid := 0
+	if decision.Action != policy.ActionAccept {
+		blocked = 1
+		allowed = 0
+	}
+	if decision.Rule == "spam_filter" {
+		spam = 1
+	}
+	if strings.HasPrefix(decision.Msg, "invalid:") {
+		invalid = 1
+	}
+
+	p := influxdb2.NewPoint(
+		w.measurement,
+		map[string]string{
+			"kind":  fmt.Sprintf("%d", e.Event.Kind),
+			"relay": relay.ID,
+		},
+		map[string]interface{}{
+			"event":   1,
+			"blocked": blocked,
+			"allowed": allowed,
+			"spam":    spam,
+			"invalid": invalid,
+		},
+		time.Now())
+	// write asynchronously
+	w.writeAPI.WritePoint(p)
+}
+
+// Close flushes pending points and closes the client
+func (w *influxWriter) Close() {
+	w.writeAPI.Flush()
+	w.client.Close()
+}
+
+// settings are the parts of the config that are reloaded on SIGHUP or when
+// .spamblaster.env / spamblaster.cfg change: the API URL or local relay
+// config file, the PRIVATE_KEY login and the influxdb writer
+type settings struct {
+	apiURL        string
+	relayFile     string // local relay config, replaces the API when set
+	relayFilePoll int    // seconds between reads of relayFile
+	pkey          string
+	influx        *influxWriter
+}
+
+var settingsMu sync.RWMutex
+var active *settings
+
+// currentSettings returns the active settings. Hold settingsMu.RLock while
+// using the influx writer, a reload closes the old one.
+func currentSettings() *settings {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return active
+}
+
+// loadSettings builds settings from the loaded viper config and the API URL
+// config file
+func loadSettings() *settings {
+	var iConfig influxdbConfig
+	// Viper unmarshals the loaded env variables into the struct
+	if err := viper.Unmarshal(&iConfig); err != nil {
+		log("could not unmarshal influxdb parts of config?!")
+	}
+	s := &settings{
+		apiURL:        readApiURL(),
+		relayFile:     viper.GetString("RELAY_CONFIG_FILE"),
+		relayFilePoll: viper.GetInt("RELAY_CONFIG_POLL_SECONDS"),
+		pkey:          viper.GetString("PRIVATE_KEY"),
+		influx:        newInfluxWriter(iConfig),
+	}
+	if s.relayFile != "" {
+		log(fmt.Sprintf("Info: using local relay config %s, the API is not used", s.relayFile))
+	}
+	if s.influx == nil {
+		log("Warn: influxdb is disabled\n")
+	}
+	log(fmt.Sprintf("Info: influxdb: %t\n", s.influx != nil))
+	return s
+}
+
+func readApiURL() string {
+	// example spamblaster config
+	apiURL := "http://127.0.0.1:3000/api/sconfig/relays/clkklcjon000wgh31mcgbut40"
+
+	body, err := os.ReadFile(apiConfigFile)
+	if err != nil {
+		log(fmt.Sprintf("unable to read config file: %v", err))
+	} else {
+		apiURL = strings.TrimSuffix(string(body), "\n")
+	}
+	return apiURL
+}
+
+// baseURL is the scheme and host of the config API
+func (s *settings) baseURL() (string, error) {
+	base, err := url.Parse(s.apiURL)
+	if err != nil {
+		return "", err
+	}
+	baseURL := &url.URL{
+		Scheme: base.Scheme,
+		Host:   base.Host,
+	}
+	return baseURL.String(), nil
+}
+
+// login signs in to the config API with the private key
+func (s *settings) login() {
+	if s.relayFile != "" {
+		return
+	}
+	baseURL, err := s.baseURL()
+	if err != nil {
+		log(fmt.Sprintf("error parsing apiURL: %v", err))
+		return
+	}
+
+	ev := signEventWithLoginToken(baseURL, s.pkey)
+	csrf := getCSRF(baseURL)
+	performLogin(baseURL, ev, csrf)
+}
+
+// reloadSettings re-reads the config files, logs in again and swaps the
+// active settings. The new settings are fully built before the swap, so
+// the event loop never waits on the API. On error the old settings stay.
+func reloadSettings() {
+	log("reloading config")
+	if err := viper.ReadInConfig(); err != nil {
+		log(fmt.Sprintf("error reloading .spamblaster.env, keeping current config: %v", err))
+		return
+	}
+	next := loadSettings()
+	next.login()
+
+	settingsMu.Lock()
+	old := active
+	active = next
+	settingsMu.Unlock()
+
+	if old != nil && old.influx != nil {
+		old.influx.Close()
+	}
+	log(fmt.Sprintf("config reloaded, api url: %s", next.apiURL))
+}
+
+// watchReload reloads the settings on SIGHUP and when either config file
+// changes. Editors often write a file in several steps, so file events are
+// debounced.
+func watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	files := map[string]bool{}
+	for _, f := range []string{viper.ConfigFileUsed(), apiConfigFile} {
+		if abs, err := filepath.Abs(f); err == nil {
+			files[abs] = true
+		}
+	}
+
+	var fileEvents chan fsnotify.Event
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log(fmt.Sprintf("could not watch config files, reload with SIGHUP: %v", err))
+	} else {
+		fileEvents = watcher.Events
+		// watch the directories, so files replaced by rename are seen
+		dirs := map[string]bool{}
+		for f := range files {
+			dirs[filepath.Dir(f)] = true
+		}
+		for d := range dirs {
+			if err := watcher.Add(d); err != nil {
+				log(fmt.Sprintf("could not watch %s: %v", d, err))
+			}
+		}
+	}
+
+	go func() {
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-hup:
+				log("received SIGHUP")
+				reloadSettings()
+			case ev := <-fileEvents:
+				if files[filepath.Clean(ev.Name)] && ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					debounce = time.After(time.Second)
+				}
+			case <-debounce:
+				debounce = nil
+				log("config file changed")
+				reloadSettings()
+			}
+		}
+	}()
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/jeremyd/spamblaster/policy"
+	"github.com/spf13/viper"
+)
+
+type reportConfig struct {
+	Actions        string `mapstructure:"REPORT_ACTIONS"`         // type=action pairs, comma separated
+	DefaultAction  string `mapstructure:"REPORT_DEFAULT_ACTION"`  // for types not in REPORT_ACTIONS
+	TimeoutSeconds int    `mapstructure:"REPORT_TIMEOUT_SECONDS"` // how long the timeout action lasts
+}
+
+func setReportDefaults() {
+	viper.SetDefault("REPORT_ACTIONS", "")
+	viper.SetDefault("REPORT_DEFAULT_ACTION", policy.ReportDelete)
+	viper.SetDefault("REPORT_TIMEOUT_SECONDS", 86400)
+}
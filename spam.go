@@ -0,0 +1,192 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+	"github.com/spf13/viper"
+)
+
+// spam filter settings from .spamblaster.env
+type spamConfig struct {
+	Enabled       bool    `mapstructure:"SPAM_FILTER"`
+	Window        int     `mapstructure:"SPAM_WINDOW"`         // recent messages kept per pubkey
+	WindowSeconds int     `mapstructure:"SPAM_WINDOW_SECONDS"` // how long recent messages are kept
+	MaxDistance   int     `mapstructure:"SPAM_MAX_DISTANCE"`   // edit distance at or below this is a repeat
+	MinRatio      float64 `mapstructure:"SPAM_MIN_RATIO"`      // similarity (0-1) at or above this is a repeat
+	MinLength     int     `mapstructure:"SPAM_MIN_LENGTH"`     // shorter content is not checked
+	MaxRepeats    int     `mapstructure:"SPAM_MAX_REPEATS"`    // repeats allowed inside the window
+}
+
+func setSpamDefaults() {
+	viper.SetDefault("SPAM_FILTER", false)
+	viper.SetDefault("SPAM_WINDOW", 10)
+	viper.SetDefault("SPAM_WINDOW_SECONDS", 3600)
+	viper.SetDefault("SPAM_MAX_DISTANCE", 3)
+	viper.SetDefault("SPAM_MIN_RATIO", 0.9)
+	viper.SetDefault("SPAM_MIN_LENGTH", 12)
+	viper.SetDefault("SPAM_MAX_REPEATS", 1)
+}
+
+// only this much of the content is compared, levenshtein is O(n*m) and runs
+// against every message in the window
+const spamCompareLimit = 512
+
+type recentMessage struct {
+	content []rune
+	at      time.Time
+}
+
+// SpamRule rejects content that is a near duplicate of recent messages
+// from the same pubkey, using levenshtein distance
+type SpamRule struct {
+	cfg spamConfig
+
+	mu      sync.Mutex
+	recent  map[string][]recentMessage
+	inserts int
+}
+
+func NewSpamRule(cfg spamConfig) *SpamRule {
+	return &SpamRule{
+		cfg:    cfg,
+		recent: make(map[string][]recentMessage),
+	}
+}
+
+func (*SpamRule) Name() string { return "spam_filter" }
+
+func (r *SpamRule) Evaluate(ev *policy.Evaluation) {
+	if !ev.Allow || policy.IsModAction(*ev.Relay, ev.Event) {
+		return
+	}
+	content := []rune(ev.Event.Event.Content)
+	if len(content) < r.cfg.MinLength {
+		return
+	}
+	if len(content) > spamCompareLimit {
+		content = content[:spamCompareLimit]
+	}
+
+	now := time.Now()
+	pubkey := ev.Event.Event.Pubkey
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	history := r.prune(r.recent[pubkey], now)
+	repeats := 0
+	for _, m := range history {
+		if r.isRepeat(content, m.content) {
+			repeats++
+		}
+	}
+
+	if !ev.DryRun {
+		history = append(history, recentMessage{content: content, at: now})
+		if r.cfg.Window > 0 && len(history) > r.cfg.Window {
+			history = history[len(history)-r.cfg.Window:]
+		}
+		r.recent[pubkey] = history
+
+		r.inserts++
+		if r.inserts%1000 == 0 {
+			r.sweep(now)
+		}
+	}
+
+	if repeats > r.cfg.MaxRepeats {
+		ev.Logf("rejecting repeated message from %s, %d similar in window", pubkey, repeats)
+		ev.Reject(r.Name(), "blocked: repeated message")
+	}
+}
+
+func (r *SpamRule) isRepeat(a, b []rune) bool {
+	longest := max(len(a), len(b))
+	if longest == 0 {
+		return true
+	}
+	// the largest distance that can still be a repeat, by either measure,
+	// one over for float rounding
+	bound := r.cfg.MaxDistance
+	if r.cfg.MinRatio <= 1 {
+		bound = max(bound, int((1-r.cfg.MinRatio)*float64(longest))+1)
+	}
+	// the distance is at least the length difference
+	if abs(len(a)-len(b)) > bound {
+		return false
+	}
+	dist := levenshteinBounded(a, b, bound)
+	if dist <= r.cfg.MaxDistance {
+		return true
+	}
+	ratio := 1 - float64(dist)/float64(longest)
+	return ratio >= r.cfg.MinRatio
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func (r *SpamRule) prune(history []recentMessage, now time.Time) []recentMessage {
+	cutoff := now.Add(-time.Duration(r.cfg.WindowSeconds) * time.Second)
+	i := 0
+	for i < len(history) && history[i].at.Before(cutoff) {
+		i++
+	}
+	return history[i:]
+}
+
+// sweep drops pubkeys that have not posted inside the window
+func (r *SpamRule) sweep(now time.Time) {
+	for k, h := range r.recent {
+		h = r.prune(h, now)
+		if len(h) == 0 {
+			delete(r.recent, k)
+		} else {
+			r.recent[k] = h
+		}
+	}
+}
+
+func levenshtein(a, b []rune) int {
+	return levenshteinBounded(a, b, len(a)+len(b))
+}
+
+// levenshteinBounded stops early once the distance is known to be over
+// bound, returning bound+1
+func levenshteinBounded(a, b []rune, bound int) int {
+	if len(a) == 0 {
+		return len(b)
+	}
+	if len(b) == 0 {
+		return len(a)
+	}
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > bound {
+			// rows never decrease, the distance is over bound
+			return bound + 1
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"abc", "abc", 0},
+		{"kitten", "sitting", 3},
+		{"flaw", "lawn", 2},
+		{"gm nostr", "gm nostr!", 1},
+		{"héllo", "hello", 1},
+		{"привет", "привот", 1},
+	}
+	for _, tt := range tests {
+		if got := levenshtein([]rune(tt.a), []rune(tt.b)); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestLevenshteinBounded(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		bound int
+		want  int
+	}{
+		{"kitten", "sitting", 3, 3},
+		{"kitten", "sitting", 5, 3},
+		{"kitten", "sitting", 1, 2},
+		{"aaaaaaaa", "bbbbbbbb", 2, 3},
+		{"abc", "abc", 0, 0},
+	}
+	for _, tt := range tests {
+		if got := levenshteinBounded([]rune(tt.a), []rune(tt.b), tt.bound); got != tt.want {
+			t.Errorf("levenshteinBounded(%q, %q, %d) = %d, want %d", tt.a, tt.b, tt.bound, got, tt.want)
+		}
+	}
+}
+
+func TestIsRepeat(t *testing.T) {
+	r := NewSpamRule(spamConfig{MaxDistance: 3, MinRatio: 0.9})
+	long := strings.Repeat("buy my coin now ", 10)
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"identical", "hello world", "hello world", true},
+		{"both empty", "", "", true},
+		{"within distance", "hello world", "hello world!!", true},
+		{"over distance, short", "hello world", "goodbye world", false},
+		{"within ratio", long, long[:len(long)-10] + "0123456789", true},
+		{"over ratio", long, strings.Repeat("x", len(long)), false},
+		{"length difference alone", "hi there", long, false},
+		{"unrelated, same length", "the quick brown fox", "jumps over the dogs", false},
+	}
+	for _, tt := range tests {
+		if got := r.isRepeat([]rune(tt.a), []rune(tt.b)); got != tt.want {
+			t.Errorf("%s: isRepeat(%q, %q) = %t, want %t", tt.name, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestIsRepeatDistanceOnly(t *testing.T) {
+	// a ratio over 1 can never match, only the distance counts
+	r := NewSpamRule(spamConfig{MaxDistance: 2, MinRatio: 1.1})
+	if !r.isRepeat([]rune("abcdef"), []rune("abcdxy")) {
+		t.Error("distance 2 should be a repeat")
+	}
+	if r.isRepeat([]rune("abcdef"), []rune("abcxyz")) {
+		t.Error("distance 3 should not be a repeat")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	relayBucket    = []byte("relay")
+	aclBucket      = []byte("acl")
+	overrideBucket = []byte("overrides")
+	managedBucket  = []byte("managed")
+	banBucket      = []byte("bans")
+	outboxBucket   = []byte("outbox")
+	historyBucket  = []byte("history")
+	currentKey     = []byte("current")
+	fetchedKey     = []byte("fetched")
+)
+
+// Store keeps state across restarts in a bbolt file, so a restarted plugin
+// can decide with the last known config while the API and ACL sources are
+// fetched again
+type Store struct {
+	db *bolt.DB
+}
+
+// savedRelay is the last good relay config, when it last changed and when
+// it was last fetched
+type savedRelay struct {
+	SavedAt   time.Time    `json:"saved_at"`
+	FetchedAt time.Time    `json:"-"` // kept under its own key
+	Relay     policy.Relay `json:"relay"`
+}
+
+// savedAcl is the pubkey set of one acl source and when it was fetched
+type savedAcl struct {
+	SavedAt time.Time `json:"saved_at"`
+	Pubkeys []string  `json:"pubkeys"`
+}
+
+func openStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{relayBucket, aclBucket, overrideBucket, managedBucket, banBucket, outboxBucket, historyBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) put(bucket []byte, key []byte, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put(key, b)
+	})
+}
+
+// get decodes the value at key into v, reporting whether it was found
+func (s *Store) get(bucket []byte, key []byte, v interface{}) (bool, error) {
+	var b []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(bucket).Get(key); data != nil {
+			b = append(b, data...)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if b == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(b, v)
+}
+
+func (s *Store) delete(bucket []byte, key []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete(key)
+	})
+}
+
+// each calls fn with every raw value in the bucket
+func (s *Store) each(bucket []byte, fn func(key []byte, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(fn)
+	})
+}
+
+func (s *Store) SaveRelay(relay policy.Relay) error {
+	return s.put(relayBucket, currentKey, savedRelay{SavedAt: time.Now().UTC(), Relay: relay})
+}
+
+// SaveRelayFetched records when the relay config was last fetched, the
+// config itself is only saved when it changes
+func (s *Store) SaveRelayFetched(t time.Time) error {
+	return s.put(relayBucket, fetchedKey, t.UTC())
+}
+
+// LoadRelay returns the last saved relay config, ok is false when there is
+// none
+func (s *Store) LoadRelay() (savedRelay, bool, error) {
+	var saved savedRelay
+	ok, err := s.get(relayBucket, currentKey, &saved)
+	if !ok || err != nil {
+		return saved, ok, err
+	}
+	found, err := s.get(relayBucket, fetchedKey, &saved.FetchedAt)
+	if err != nil {
+		return saved, ok, err
+	}
+	if !found || saved.FetchedAt.Before(saved.SavedAt) {
+		saved.FetchedAt = saved.SavedAt
+	}
+	return saved, ok, nil
+}
+
+func (s *Store) SaveAcl(sourceID string, pubkeys []string) error {
+	return s.put(aclBucket, []byte(sourceID), savedAcl{SavedAt: time.Now().UTC(), Pubkeys: pubkeys})
+}
+
+func (s *Store) LoadAcl(sourceID string) (savedAcl, bool, error) {
+	var saved savedAcl
+	ok, err := s.get(aclBucket, []byte(sourceID), &saved)
+	return saved, ok, err
+}
+
+func (s *Store) DeleteAcl(sourceID string) error {
+	return s.delete(aclBucket, []byte(sourceID))
+}
+
+// saveAclFromMap saves the pubkeys currently loaded for an acl source
+func (s *Store) saveAclFromMap(sourceID string, m *sync.Map) {
+	var pubkeys []string
+	m.Range(func(k, v interface{}) bool {
+		if v == sourceID {
+			pubkeys = append(pubkeys, k.(string))
+		}
+		return true
+	})
+	if err := s.SaveAcl(sourceID, pubkeys); err != nil {
+		log(fmt.Sprintf("error saving acl %s: %s", sourceID, err.Error()))
+	}
+}
+
+// restore loads the saved relay config and the saved pubkeys of its acl
+// sources into m. Sources the saved relay no longer has are not loaded.
+func (s *Store) restore(m *sync.Map) (policy.Relay, bool) {
+	saved, ok, err := s.LoadRelay()
+	if err != nil {
+		log(fmt.Sprintf("error loading saved relay config: %s", err.Error()))
+		return policy.Relay{}, false
+	}
+	if !ok {
+		log("no saved relay config")
+		return policy.Relay{}, false
+	}
+	relay := saved.Relay
+	log(fmt.Sprintf("loaded relay config fetched at %s (%s old), unchanged since %s", saved.FetchedAt.Format(time.RFC3339), time.Since(saved.FetchedAt).Round(time.Second), saved.SavedAt.Format(time.RFC3339)))
+	updateSyncMapFromRelay(relay, m)
+
+	for _, as := range relay.AclSources {
+		acl, ok, err := s.LoadAcl(as.ID)
+		if err != nil {
+			log(fmt.Sprintf("error loading saved acl %s: %s", as.ID, err.Error()))
+			continue
+		}
+		if !ok {
+			continue
+		}
+		for _, p := range acl.Pubkeys {
+			m.LoadOrStore(p, as.ID)
+		}
+		log(fmt.Sprintf("loaded %d pubkeys for %s:%s fetched at %s (%s old)", len(acl.Pubkeys), as.Url, as.ID, acl.SavedAt.Format(time.RFC3339), time.Since(acl.SavedAt).Round(time.Second)))
+	}
+	return relay, true
+}
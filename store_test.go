@@ -0,0 +1,43 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jeremyd/spamblaster/policy"
+)
+
+func TestLoadRelayFetchedAt(t *testing.T) {
+	s, err := openStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, ok, err := s.LoadRelay(); ok || err != nil {
+		t.Fatalf("LoadRelay on an empty db = %t, %v", ok, err)
+	}
+	if err := s.SaveRelay(policy.Relay{ID: "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	saved, ok, err := s.LoadRelay()
+	if !ok || err != nil {
+		t.Fatalf("LoadRelay = %t, %v", ok, err)
+	}
+	if !saved.FetchedAt.Equal(saved.SavedAt) {
+		t.Errorf("without a fetch time FetchedAt = %s, want SavedAt %s", saved.FetchedAt, saved.SavedAt)
+	}
+
+	fetched := saved.SavedAt.Add(time.Hour)
+	if err := s.SaveRelayFetched(fetched); err != nil {
+		t.Fatal(err)
+	}
+	saved, _, err = s.LoadRelay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.FetchedAt.Equal(fetched) || saved.Relay.ID != "r1" {
+		t.Errorf("LoadRelay = fetched %s relay %q, want %s r1", saved.FetchedAt, saved.Relay.ID, fetched)
+	}
+}
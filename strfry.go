@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// strfry command settings from .spamblaster.env
+type strfryConfig struct {
+	Bin            string `mapstructure:"STRFRY_BIN"`                    // path to the strfry binary
+	Config         string `mapstructure:"STRFRY_CONFIG"`                 // strfry.conf, strfry's default when empty
+	TimeoutSeconds int    `mapstructure:"STRFRY_DELETE_TIMEOUT_SECONDS"` // a delete running longer is killed
+	Batch          int    `mapstructure:"STRFRY_DELETE_BATCH"`           // ids or authors per delete
+}
+
+func setStrfryDefaults() {
+	viper.SetDefault("STRFRY_BIN", "/app/strfry")
+	viper.SetDefault("STRFRY_CONFIG", "")
+	viper.SetDefault("STRFRY_DELETE_TIMEOUT_SECONDS", 300)
+	viper.SetDefault("STRFRY_DELETE_BATCH", 100)
+}
+
+// strfry prints "Deleted N events" when it is done
+var strfryDeleted = regexp.MustCompile(`(?i)deleted (\d+) events?`)
+
+// strfryDeleter runs strfry delete in a background worker, so a slow delete
+// does not hold up the event loop. Queued ids and authors are batched into
+// one filter each, and queueing the same one twice deletes it once.
+type strfryDeleter struct {
+	cfg strfryConfig
+
+	mu      sync.Mutex
+	ids     []string
+	authors []string
+	queued  map[string]bool
+	wake    chan struct{}
+}
+
+func newStrfryDeleter(cfg strfryConfig) *strfryDeleter {
+	if cfg.Batch < 1 {
+		cfg.Batch = 1
+	}
+	return &strfryDeleter{
+		cfg:    cfg,
+		queued: make(map[string]bool),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// deleter runs the mod action deletes, set up in main
+var deleter *strfryDeleter
+
+func (d *strfryDeleter) DeleteEvent(id string) {
+	d.enqueue(&d.ids, "ids:"+id, id)
+}
+
+func (d *strfryDeleter) DeleteAuthor(pubkey string) {
+	d.enqueue(&d.authors, "authors:"+pubkey, pubkey)
+}
+
+func (d *strfryDeleter) enqueue(list *[]string, key string, v string) {
+	d.mu.Lock()
+	if !d.queued[key] {
+		d.queued[key] = true
+		*list = append(*list, v)
+	}
+	d.mu.Unlock()
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next takes up to a batch of queued ids, or else authors. field is empty
+// when the queue is empty.
+func (d *strfryDeleter) next() (field string, values []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	take := func(list *[]string, name string) {
+		n := min(len(*list), d.cfg.Batch)
+		values = append(values, (*list)[:n]...)
+		*list = (*list)[n:]
+		for _, v := range values {
+			delete(d.queued, name+":"+v)
+		}
+		field = name
+	}
+	if len(d.ids) > 0 {
+		take(&d.ids, "ids")
+	} else if len(d.authors) > 0 {
+		take(&d.authors, "authors")
+	}
+	return field, values
+}
+
+// Start runs the worker in the background
+func (d *strfryDeleter) Start() {
+	log(fmt.Sprintf("Info: strfry deletes run %s, timeout %ds, batches of %d", d.command(), d.cfg.TimeoutSeconds, d.cfg.Batch))
+	go func() {
+		for range d.wake {
+			for {
+				field, values := d.next()
+				if field == "" {
+					break
+				}
+				d.run(field, values)
+			}
+		}
+	}()
+}
+
+func (d *strfryDeleter) command() string {
+	if d.cfg.Config != "" {
+		return d.cfg.Bin + " --config=" + d.cfg.Config + " delete"
+	}
+	return d.cfg.Bin + " delete"
+}
+
+func (d *strfryDeleter) run(field string, values []string) {
+	filter, _ := json.Marshal(map[string][]string{field: values})
+
+	ctx := context.Background()
+	if d.cfg.TimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(d.cfg.TimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+	var args []string
+	if d.cfg.Config != "" {
+		args = append(args, "--config="+d.cfg.Config)
+	}
+	args = append(args, "delete", "--filter", string(filter))
+
+	start := time.Now()
+	out, err := exec.CommandContext(ctx, d.cfg.Bin, args...).CombinedOutput()
+	took := time.Since(start).Round(time.Millisecond)
+	if ctx.Err() == context.DeadlineExceeded {
+		log(fmt.Sprintf("strfry delete of %d %s timed out after %s", len(values), field, took))
+		return
+	}
+	if err != nil {
+		log(fmt.Sprintf("strfry delete of %d %s failed after %s: %v: %s", len(values), field, took, err, strings.TrimSpace(string(out))))
+		return
+	}
+	removed := "an unknown number of"
+	if m := strfryDeleted.FindStringSubmatch(string(out)); m != nil {
+		removed = m[1]
+	}
+	log(fmt.Sprintf("strfry delete of %d %s removed %s events in %s", len(values), field, removed, took))
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+)
+
+type timeoutConfig struct {
+	Reaction   string `mapstructure:"MOD_TIMEOUT_REACTION"`    // reaction that times out the author, empty turns it off
+	Seconds    int    `mapstructure:"MOD_TIMEOUT_SECONDS"`     // without a duration tag
+	MaxSeconds int    `mapstructure:"MOD_TIMEOUT_MAX_SECONDS"` // longest duration tag honoured, 0 no limit
+}
+
+func setTimeoutDefaults() {
+	viper.SetDefault("MOD_TIMEOUT_REACTION", "⏳")
+	viper.SetDefault("MOD_TIMEOUT_SECONDS", 3600)
+	viper.SetDefault("MOD_TIMEOUT_MAX_SECONDS", 30*86400)
+}
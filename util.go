@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 )
@@ -24,6 +25,7 @@ func signEventWithLoginToken(baseURL string, privateKey string) nostr.Event {
 	resp, err := client.Do(req)
 	if err != nil {
 		log(fmt.Sprintf("Error occured. Error is: %s", err.Error()))
+		return nostr.Event{}
 	}
 	defer resp.Body.Close()
 	var data map[string]interface{}
@@ -53,6 +55,7 @@ func getCSRF(baseURL string) string {
 	resp, err := client.Do(req)
 	if err != nil {
 		log(fmt.Sprintf("Error occured. Error is: %s", err.Error()))
+		return ""
 	}
 	defer resp.Body.Close()
 	var csrfData map[string]interface{}
@@ -82,12 +85,14 @@ func performLogin(baseURL string, ev nostr.Event, csrf string) {
 	resp, err := client.Do(req)
 	if err != nil {
 		log(fmt.Sprintf("Error occurred while making request. Error is: %s", err.Error()))
+		return
 	}
 	defer resp.Body.Close()
 }
 
 func init() {
 	client = http.Client{
-		Jar: jar,
+		Jar:     jar,
+		Timeout: 30 * time.Second,
 	}
 }